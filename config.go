@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// configName is the name of the config file which is
+// read from the working directory if -config is not set.
+const configName = ".wfr2retry.yaml"
+
+// option is a single value of the config file.
+type option struct {
+	line      int
+	name, val string
+}
+
+// loadConfig reads the config file and sets the flags of fs
+// which are not set on the command line to its values.
+// The config file is a flat YAML mapping of flag names to
+// values. Repeatable flags take a list of values.
+//
+//   retry-pkg: github.com/hashicorp/consul/sdk/testutil/retry
+//   timeout: 5s
+//   errorf-funcs: errf,errors.Newf
+//   exclude:
+//     - mock_*
+//     - legacy/*
+//
+func loadConfig(fs *flag.FlagSet, fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	options, err := parseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s:%s", fname, err)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, o := range options {
+		if fs.Lookup(o.name) == nil {
+			return fmt.Errorf("%s:%d: unknown option %q", fname, o.line, o.name)
+		}
+		if set[o.name] {
+			continue
+		}
+		if err := fs.Set(o.name, o.val); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %s", fname, o.line, o.val, o.name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig parses the 'name: value' lines and the
+// '- value' list items of the config file. Empty lines
+// and comments are ignored.
+func parseConfig(data []byte) ([]option, error) {
+	var options []option
+	var list string
+	for i, line := range strings.Split(string(data), "\n") {
+		n := i + 1
+		if j := strings.Index(line, " #"); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "- ") {
+			if list == "" {
+				return nil, fmt.Errorf("%d: list item without an option", n)
+			}
+			options = append(options, option{n, list, unquote(line[2:])})
+			continue
+		}
+		j := strings.Index(line, ":")
+		if j < 0 {
+			return nil, fmt.Errorf("%d: expected 'name: value'", n)
+		}
+		name, val := strings.TrimSpace(line[:j]), strings.TrimSpace(line[j+1:])
+		list = ""
+		if val == "" {
+			list = name
+			continue
+		}
+		options = append(options, option{n, name, unquote(val)})
+	}
+	return options, nil
+}
+
+// unquote removes the quotes of a single or
+// double quoted value.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
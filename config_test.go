@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magiconair/wfr2retry/transform"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config := `# defaults for the migration
+retry-pkg: "example.com/retry"
+timeout: 5s
+wait: 10ms # poll faster
+errorf-funcs: errf
+exclude:
+  - mock_*
+  - legacy/*
+`
+	fname := filepath.Join(t.TempDir(), configName)
+	if err := ioutil.WriteFile(fname, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	o := transform.DefaultOptions()
+	var excl stringList
+	fs := flag.NewFlagSet("wfr2retry", flag.ContinueOnError)
+	fs.StringVar(&o.RetryPkg, "retry-pkg", o.RetryPkg, "")
+	fs.DurationVar(&o.Timeout, "timeout", 0, "")
+	fs.DurationVar(&o.Wait, "wait", o.Wait, "")
+	errorfFuncs := fs.String("errorf-funcs", "", "")
+	fs.Var(&excl, "exclude", "")
+	if err := fs.Parse([]string{"-timeout", "2s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, fname); err != nil {
+		t.Fatal(err)
+	}
+	o.ErrorfFuncs = strings.Split(*errorfFuncs, ",")
+
+	if got, want := o.Timeout, 2*time.Second; got != want {
+		t.Fatalf("got timeout %v want %v from the command line", got, want)
+	}
+	if got, want := excl, (stringList{"mock_*", "legacy/*"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got excludes %v want %v", got, want)
+	}
+
+	in := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return false, errf("not ready: %d", n)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"example.com/retry"
+	"time"
+)
+
+func TestFoo(t *testing.T) {
+	for r := (&retry.Timer{Timeout: 2 * time.Second, Wait: 10 * time.Millisecond}); r.NextOr(t.FailNow); {
+		t.Logf("not ready: %d", n)
+		continue
+	}
+}
+`
+	got, _, err := transform.TransformFile("foo_test.go", []byte(in), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		config, err string
+	}{
+		{"retry-pkg: x\nfoo: bar\n", "unknown option \"foo\""},
+		{"timeout: soon\n", "invalid value \"soon\" for timeout"},
+		{"- mock_*\n", "list item without an option"},
+		{"timeout 5s\n", "expected 'name: value'"},
+	}
+	for _, tt := range tests {
+		fname := filepath.Join(t.TempDir(), configName)
+		if err := ioutil.WriteFile(fname, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fs := flag.NewFlagSet("wfr2retry", flag.ContinueOnError)
+		fs.String("retry-pkg", "", "")
+		fs.Duration("timeout", 0, "")
+		err := loadConfig(fs, fname)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%q: got error %v want %s", tt.config, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// context is the number of unchanged lines
+// around a change in a unified diff.
+const context = 3
+
+// edit describes a single line of an edit script.
+// op is one of ' ' (equal), '-' (delete) or '+' (insert).
+type edit struct {
+	op   byte
+	line string
+}
+
+// unifiedDiff returns a unified diff between the original
+// and the transformed source of the file. It returns nil
+// if both are identical.
+func unifiedDiff(fname string, a, b []byte) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	edits := diffLines(splitLines(a), splitLines(b))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s.orig\n+++ %s\n", fname, fname)
+
+	// line numbers of the edit at index i
+	aline, bline := make([]int, len(edits)+1), make([]int, len(edits)+1)
+	for i, e := range edits {
+		aline[i+1], bline[i+1] = aline[i], bline[i]
+		if e.op != '+' {
+			aline[i+1]++
+		}
+		if e.op != '-' {
+			bline[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+
+		// extend the hunk until there are more than
+		// 2*context unchanged lines after a change.
+		start := max(i-context, 0)
+		end, eq := i, 0
+		for ; end < len(edits) && eq <= 2*context; end++ {
+			if edits[end].op == ' ' {
+				eq++
+			} else {
+				eq = 0
+			}
+		}
+		end -= max(eq-context, 0)
+
+		na, nb := aline[end]-aline[start], bline[end]-bline[start]
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(aline[start], na), hunkRange(bline[start], nb))
+		for _, e := range edits[start:end] {
+			buf.WriteByte(e.op)
+			buf.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return buf.Bytes()
+}
+
+// writeDiff writes the diff to out. If a diff tool is set
+// the diff is piped through it and its output is written
+// instead. The plain diff is written if the tool fails.
+func writeDiff(out io.Writer, diff []byte) error {
+	if diffTool != "" && len(diff) > 0 {
+		formatted, err := pipeDiff(diffTool, diff)
+		if err == nil {
+			_, err = out.Write(formatted)
+			return err
+		}
+		log.Print(err)
+	}
+	_, err := out.Write(diff)
+	return err
+}
+
+// pipeDiff runs the diff tool with the diff as input and
+// returns its output. The tool may have arguments which
+// are separated by spaces.
+func pipeDiff(tool string, diff []byte) ([]byte, error) {
+	args := strings.Fields(tool)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(diff)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// hunkRange formats the line range of a hunk. start is the
+// zero based index of the first line of the hunk.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// splitLines splits the text into lines
+// which keep their trailing newline.
+func splitLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes the shortest edit script
+// between a and b with the Myers algorithm.
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+
+	// trace[d] holds the furthest reaching paths for
+	// the diagonals -d..d before step d.
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+	panic("unreachable")
+}
+
+// backtrack walks the trace of diffLines backwards
+// and returns the edit script.
+func backtrack(trace [][]int, a, b []string) []edit {
+	var edits []edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		prev := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prev = k + 1
+		}
+		px := at(prev)
+		py := px - prev
+		for x > px && y > py {
+			x, y = x-1, y-1
+			edits = append(edits, edit{' ', a[x]})
+		}
+		if x == px {
+			y--
+			edits = append(edits, edit{'+', b[y]})
+		} else {
+			x--
+			edits = append(edits, edit{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		edits = append(edits, edit{' ', a[x]})
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/magiconair/wfr2retry/transform"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		desc, a, b, diff string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{
+			"change",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			"--- f.go.orig\n+++ f.go\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"insert at start",
+			"a\nb\n",
+			"x\na\nb\n",
+			"--- f.go.orig\n+++ f.go\n@@ -1,2 +1,3 @@\n+x\n a\n b\n",
+		},
+		{
+			"two hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			"--- f.go.orig\n+++ f.go\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+		{
+			"missing newline",
+			"a",
+			"b\n",
+			"--- f.go.orig\n+++ f.go\n@@ -1,1 +1,1 @@\n-a\n\\ No newline at end of file\n+b\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got, want := string(unifiedDiff("f.go", []byte(tt.a), []byte(tt.b))), tt.diff; got != want {
+				t.Fatalf("got \n%s\nwant\n%s\n", got, want)
+			}
+		})
+	}
+}
+
+func TestDiffTransform(t *testing.T) {
+	src := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	data, _, err := transform.TransformFile("foo_test.go", []byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := string(unifiedDiff("foo_test.go", []byte(src), data))
+	for _, want := range []string{
+		"-\tif err := testutil.WaitForResult(func() (bool, error) {\n",
+		"+\tfor r := retry.OneSec(); r.NextOr(t.FailNow); {\n",
+		"-\t\"github.com/hashicorp/consul/testutil\"\n",
+		"+\t\"github.com/hashicorp/consul/sdk/testutil/retry\"\n",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff does not contain %q\n%s", want, diff)
+		}
+	}
+}
+
+func TestDiffTool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell script")
+	}
+	defer func(d bool, tool string) { showDiff, diffTool = d, tool }(showDiff, diffTool)
+	showDiff = true
+
+	dir := t.TempDir()
+	received := filepath.Join(dir, "received")
+	scripts := map[string]string{
+		"fakediff":   "#!/bin/sh\ncat > " + received + "\necho colored\n",
+		"brokendiff": "#!/bin/sh\necho broken >&2\nexit 1\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	var plain bytes.Buffer
+	if _, _, err := processFile("foo_test.go", src, &plain); err != nil {
+		t.Fatal(err)
+	}
+
+	diffTool = "fakediff"
+	var out bytes.Buffer
+	if _, _, err := processFile("foo_test.go", src, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "colored\n"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	data, err := ioutil.ReadFile(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != plain.String() {
+		t.Fatalf("diff tool got\n%s\nwant\n%s", data, plain.String())
+	}
+
+	diffTool = "brokendiff"
+	out.Reset()
+	if _, _, err := processFile("foo_test.go", src, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != plain.String() {
+		t.Fatalf("got\n%s\nwant the plain diff\n%s", out.String(), plain.String())
+	}
+}
@@ -1,377 +1,827 @@
 // wfr2retry rewrites calls from WaitForResult to use the retry package.
 //
-// It transforms from
-//
-//   if err := testutil.WaitForResult(func() (bool, error) {
-//       if err := foo(); err != nil {
-//           return false, fmt.Errorf("foo: %s", err)
-//       }
-//       return true, nil
-//   }); err != nil {
-//       t.Fatal(err)
-//   }
-//
-// to
-//
-//   for r := retry.OneSec(); r.NextOr(t.FailNow); {
-//       if err := foo(); err != nil {
-//           t.Logf("foo: %s", err)
-//           continue
-//       }
-//       break
-//   }
-//
+// The rewrite is implemented by the transform package.
+// See there for the details.
 package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"go/ast"
-	"go/format"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 
-	"github.com/magiconair/wfr2retry/apply"
+	"github.com/magiconair/wfr2retry/transform"
 )
 
-var write, printAST bool
+var write, backup, printAST, useGoimports, recursive, showDiff, check, listFiles, allErrors, list, stdin, jsonReport, dryRun bool
+
+// opts are the options of the rewrite which are set by the flags.
+var opts = transform.DefaultOptions()
+
+// stdinName is the file name for errors of the source read from stdin.
+var stdinName string
+
+// astOutput receives the AST dumps of -ast and -ast-after.
+var astOutput io.Writer = os.Stdout
+
+// diffTool is the command which formats the diffs of -d.
+var diffTool string
+
+// since is the git ref of -since whose changed test
+// files are transformed.
+var since string
+
+// filesFrom is the file of -files-from which lists the
+// files to transform.
+var filesFrom string
+
+// runGit runs git with the arguments and returns its
+// output. Tests replace it to stub the git command.
+var runGit = func(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// jobs is the number of files which are processed concurrently.
+var jobs int
+
+// excludes contains the glob patterns of files which are
+// skipped when walking a directory.
+var excludes stringList
+
+// stringList is a flag.Value for repeatable string flags.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+// formatMode controls the formatting of the output.
+//
+//   none:      format only the changed declarations
+//   gofmt:     format the whole file
+//   goimports: like none and pipe the result through goimports
+var formatMode = "none"
 
 func main() {
+	config := flag.String("config", "", "read the defaults of the flags from this file instead of "+configName)
 	flag.BoolVar(&write, "w", false, "write changes to file")
+	flag.BoolVar(&backup, "backup", false, "copy files to file.orig before writing the changes with -w")
+	v := flag.Bool("v", false, "log the decisions of the rewrite")
 	flag.BoolVar(&printAST, "ast", false, "print ast and exit")
+	astAfter := flag.Bool("ast-after", false, "print ast after the transformation")
+	trace := flag.Bool("trace", false, "print every replaced statement next to its replacement")
+	astOut := flag.String("ast-out", "", "write the ast of -ast and -ast-after to this file instead of stdout")
+	flag.BoolVar(&stdin, "stdin", false, "read the source from stdin and print the result to stdout. Same as '-' as file argument")
+	flag.StringVar(&stdinName, "stdin-name", "<stdin>", "file name of the source read from stdin for error messages")
+	flag.BoolVar(&list, "list", false, "list the WaitForResult calls in the files without changing them")
+	flag.BoolVar(&listFiles, "l", false, "list files which would change like gofmt -l")
+	flag.BoolVar(&allErrors, "e", false, "report the errors of the files with -l")
+	flag.BoolVar(&jsonReport, "json", false, "print a JSON summary of the conversions of every file without changing them")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the first line of every converted statement before and after the rewrite without changing the files")
+	flag.BoolVar(&check, "check", false, "list files which would change and exit with status 1 if there are any")
+	flag.BoolVar(&showDiff, "d", false, "print a unified diff instead of the rewritten file")
+	flag.BoolVar(&showDiff, "diff", false, "same as -d")
+	flag.StringVar(&diffTool, "diff-tool", "", "pipe the diffs of -d through this command, e.g. delta or colordiff")
+	flag.BoolVar(&useGoimports, "goimports", false, "pipe output through goimports. Same as -format=goimports")
+	flag.StringVar(&formatMode, "format", formatMode, "formatting of the output: none, gofmt or goimports")
+	flag.IntVar(&opts.TabWidth, "tabwidth", 0, "tab width of the output. Default is the one of gofmt")
+	flag.BoolVar(&opts.UseSpaces, "use-spaces", false, "indent the output with spaces instead of tabs")
+	flag.BoolVar(&opts.Inline, "inline", false, "inline local callback functions instead of calling them")
+	flag.BoolVar(&opts.MergeAdjacent, "merge-adjacent", false, "merge adjacent loops with the same retryer into one loop")
+	flag.BoolVar(&opts.NoReceiverSwap, "no-receiver-swap", false, "keep NoError assertions of the *testing.T in callbacks which then fail the test")
+	flag.BoolVar(&opts.NoHoist, "no-hoist", false, "do not move setup statements of the callback before the loop")
+	flag.BoolVar(&recursive, "r", false, "transform all _test.go files in directories recursively")
+	flag.StringVar(&since, "since", "", "transform only the _test.go files which changed since this git ref")
+	flag.StringVar(&filesFrom, "files-from", "", "also transform the files listed in this file, one per line")
+	flag.IntVar(&jobs, "j", 1, "number of files to process concurrently")
+	flag.Var(&excludes, "exclude", "skip files matching this glob pattern in directories (repeatable)")
+	match := flag.String("match", strings.Join(opts.Match, ","), "comma separated forms of calls to convert: waitforresult, pollwaiton")
+	flag.Var((*stringList)(&opts.Packages), "package", "convert only the WaitForResult calls of the package with this name (repeatable)")
+	flag.StringVar(&opts.RetryPkg, "retry-pkg", opts.RetryPkg, "import path of the retry package")
+	flag.StringVar(&opts.RetryAlias, "retry-alias", "", "local name of the retry package")
+	flag.StringVar(&opts.RetryAPI, "retry-api", opts.RetryAPI, "method set of the retry package: v1 for r.NextOr(t.FailNow) or v2 for r.NextOr(t, t.FailNow)")
+	flag.DurationVar(&opts.Timeout, "timeout", 0, "use a retry.Timer with this timeout instead of retry.OneSec()")
+	flag.IntVar(&opts.Attempts, "attempts", 0, "use a retry.Counter with this number of attempts instead of retry.OneSec()")
+	flag.DurationVar(&opts.Wait, "wait", opts.Wait, "poll interval of the retry.Timer")
+	assertPkgs := flag.String("assert-pkgs", strings.Join(opts.AssertPkgs, ","), "comma separated names of assertion packages to warn about in callbacks")
+	errorfFuncs := flag.String("errorf-funcs", "", "comma separated names of printf-style error constructors like errf or errors.Newf")
+	flag.StringVar(&opts.NilMessage, "nil-message", "", "message to log for retries without an error value")
+	flag.StringVar(&opts.BoolMessage, "bool-message", opts.BoolMessage, "message to log for retries of callbacks which return only a bool")
+	flag.BoolVar(&opts.Verify, "verify", false, "type check the file after the rewrite and report the errors instead of writing it")
+	flag.StringVar(&opts.ReturnErr, "return-err", opts.ReturnErr, "handling of calls whose error check returns the error: warn or convert")
+	flag.StringVar(&opts.Defer, "defer", opts.Defer, "handling of defer statements in callbacks: hoist, keep or warn")
 	flag.Parse()
 
 	log.SetFlags(0)
 	log.SetPrefix("***** ")
 
-	for _, fname := range flag.Args() {
-		data, err := transformFile(fname, nil)
+	// the flags of the command line override the config file.
+	if *config == "" {
+		if _, err := os.Stat(configName); err == nil {
+			*config = configName
+		}
+	}
+	if *config != "" {
+		if err := loadConfig(flag.CommandLine, *config); err != nil {
+			fatal(errCode(err), err)
+		}
+	}
+	opts.Warnings = os.Stderr
+	if *v {
+		opts.Log = os.Stderr
+	}
+
+	opts.AssertPkgs = nil
+	for _, p := range strings.Split(*assertPkgs, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			opts.AssertPkgs = append(opts.AssertPkgs, p)
+		}
+	}
+
+	opts.Match = nil
+	for _, m := range strings.Split(*match, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			opts.Match = append(opts.Match, m)
+		}
+	}
+	for _, m := range opts.Match {
+		switch m {
+		case "waitforresult", "pollwaiton":
+		default:
+			fatalf(exitError, "invalid match %q", m)
+		}
+	}
+
+	for _, f := range strings.Split(*errorfFuncs, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			opts.ErrorfFuncs = append(opts.ErrorfFuncs, f)
+		}
+	}
+
+	for _, pattern := range excludes {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			fatalf(exitError, "invalid exclude pattern %q", pattern)
+		}
+	}
+
+	switch formatMode {
+	case "none", "gofmt", "goimports":
+	default:
+		fatalf(exitError, "invalid format %q", formatMode)
+	}
+
+	if opts.Attempts < 0 || isSet("attempts") && opts.Attempts == 0 {
+		fatalf(exitError, "invalid number of attempts %d", opts.Attempts)
+	}
+	if opts.Attempts > 0 && opts.Timeout > 0 {
+		fatal(exitError, "cannot use -attempts with -timeout")
+	}
+
+	switch opts.RetryAPI {
+	case "v1", "v2":
+	default:
+		fatalf(exitError, "invalid retry api %q", opts.RetryAPI)
+	}
+
+	switch opts.ReturnErr {
+	case "warn", "convert":
+	default:
+		fatalf(exitError, "invalid return-err mode %q", opts.ReturnErr)
+	}
+
+	switch opts.Defer {
+	case "hoist", "keep", "warn":
+	default:
+		fatalf(exitError, "invalid defer mode %q", opts.Defer)
+	}
+
+	if *astOut != "" {
+		f, err := os.Create(*astOut)
 		if err != nil {
-			log.Fatal(err)
+			fatal(exitIO, err)
 		}
+		defer f.Close()
+		astOutput = f
+	}
+	if *astAfter {
+		opts.ASTAfter = astOutput
+	}
+	if *trace {
+		opts.Trace = astOutput
+	}
+
+	if stdin || (flag.NArg() == 1 && flag.Arg(0) == "-") {
 		if write {
-			if err := ioutil.WriteFile(fname, data, 0644); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			os.Stdout.Write(data)
+			fatal(exitError, "cannot use -w with stdin")
+		}
+		if _, _, err := processFile(stdinName, os.Stdin, os.Stdout); err != nil {
+			logError(err)
+			os.Exit(errCode(err))
 		}
+		return
 	}
-}
 
-func transformFile(fname string, src interface{}) ([]byte, error) {
-	// parse input
-	fset := token.NewFileSet()
-	root, err := parser.ParseFile(fset, fname, src, parser.ParseComments)
+	files, err := inputFiles(flag.Args())
 	if err != nil {
-		return nil, err
+		fatal(errCode(err), err)
 	}
 
-	// not pretty ... :(
-	if printAST {
-		ast.Print(fset, root)
-		os.Exit(0)
+	if list {
+		for _, fname := range files {
+			src, err := ioutil.ReadFile(fname)
+			if err != nil {
+				fatal(exitIO, err)
+			}
+			calls, err := transform.List(fname, src)
+			if err != nil {
+				fatal(exitError, err)
+			}
+			for _, c := range calls {
+				fmt.Println(c)
+			}
+		}
+		return
 	}
 
-	// apply transformation
-	// todo(fs): we probably need to fix the imports or run goimports afterwards
-	apply.Apply(root, rewrite, nil)
+	// the AST dumps and the trace share a single writer.
+	if printAST || opts.ASTAfter != nil || opts.Trace != nil {
+		jobs = 1
+	}
 
-	// format transformed code
-	var b bytes.Buffer
-	if err := format.Node(&b, fset, root); err != nil {
-		return nil, err
+	if jsonReport {
+		if err := printReport(os.Stdout, processFiles(files, jobs)); err != nil {
+			fatal(exitIO, err)
+		}
+		return
 	}
-	return b.Bytes(), nil
-}
 
-// rewrite recursively rewrites the if statements
-// which use the testutil.WaitForResult construct
-// and replaces them with a for loop which uses
-// the retry package.
-func rewrite(c apply.ApplyCursor) bool {
-	switch c.Node().(type) {
-	case *ast.IfStmt:
-		var body *ast.BlockStmt
-		arg := wfrBody(c.Node())
-		switch x := arg.(type) {
-		case *ast.Ident:
-			body = makeSimpleBody(x)
-		case *ast.BlockStmt:
-			body = rewriteBody(x)
-		default:
-			return true
+	results := processFiles(files, jobs)
+	if dryRun {
+		printPreviews(os.Stdout, results)
+		exit(exitCode(results, false, true))
+		return
+	}
+	if listFiles {
+		reportChanged(os.Stdout, os.Stderr, results)
+		exit(exitCode(results, true, allErrors))
+		return
+	}
+
+	// files with unsupported constructs are reported
+	// and skipped so that the remaining files are still
+	// converted.
+	changed, failed, total := 0, 0, 0
+	for _, r := range results {
+		fname, n, ok := r.fname, r.n, r.changed
+		os.Stdout.Write(r.out)
+		if r.err != nil {
+			logError(r.err)
+			failed++
+			continue
+		}
+		if ok {
+			changed++
 		}
-		c.Replace(makeForRetry(body))
+		if check {
+			if ok {
+				fmt.Println(fname)
+			}
+			continue
+		}
+		if n > 0 {
+			log.Printf("%s: %d WaitForResult calls converted", fname, n)
+		}
+		total += n
+	}
+	if check {
+		exit(exitCode(results, true, true))
+		return
+	}
+	if recursive {
+		log.Printf("%d of %d files changed", changed, len(files))
+	}
+	log.Printf("%d WaitForResult calls converted", total)
+	if failed > 0 {
+		log.Printf("%d files failed", failed)
 	}
-	return true
+	exit(exitCode(results, false, true))
 }
 
-func makeSimpleBody(s *ast.Ident) *ast.BlockStmt {
-	return &ast.BlockStmt{
-		List: []ast.Stmt{
-			&ast.IfStmt{
-				Init: &ast.AssignStmt{
-					Lhs: []ast.Expr{
-						&ast.Ident{Name: "err"},
-					},
-					Tok: token.DEFINE,
-					Rhs: []ast.Expr{
-						&ast.CallExpr{Fun: s},
-					},
-				},
-				Cond: &ast.BinaryExpr{
-					X:  &ast.Ident{Name: "err"},
-					Op: token.NEQ,
-					Y:  &ast.Ident{Name: "nil"},
-				},
-				Body: &ast.BlockStmt{
-					List: []ast.Stmt{
-						&ast.ExprStmt{
-							&ast.CallExpr{
-								Fun: &ast.SelectorExpr{
-									X:   &ast.Ident{Name: "t"},
-									Sel: &ast.Ident{Name: "Log"},
-								},
-								Args: []ast.Expr{
-									&ast.Ident{Name: "err"},
-								},
-							},
-						},
-						&ast.BranchStmt{Tok: token.CONTINUE},
-					},
-				},
-			},
-			&ast.BranchStmt{Tok: token.BREAK},
-		},
+// The exit codes of wfr2retry.
+const (
+	// exitOK is returned if nothing changed or
+	// all changes were written.
+	exitOK = 0
+
+	// exitChanged is returned by -check and -l
+	// if files would change.
+	exitChanged = 1
+
+	// exitError is returned for invalid flags and
+	// files which cannot be parsed or transformed.
+	exitError = 2
+
+	// exitIO is returned if files cannot be read
+	// or written.
+	exitIO = 3
+)
+
+// exitCode returns the exit code for the results. I/O
+// errors take precedence over the other errors which take
+// precedence over changed files. Changed files are only
+// counted with changes and errors only with errs.
+func exitCode(results []result, changes, errs bool) int {
+	code := exitOK
+	for _, r := range results {
+		switch {
+		case r.err != nil && errs:
+			code = max(code, errCode(r.err))
+		case r.err == nil && r.changed && changes:
+			code = max(code, exitChanged)
+		}
 	}
+	return code
 }
 
-// wfrBody checks if the node is an if statement
-// of the form and returns the body of the callback function.
-// or the name of the test function.
-func wfrBody(n ast.Node) ast.Node {
-	// if init; cond { body } ?
-	if ifn, ok := n.(*ast.IfStmt); ok && ifn.Init != nil && ifn.Body != nil {
+// errCode returns exitIO for errors of the file system
+// and exitError for all other errors.
+func errCode(err error) int {
+	var (
+		pathErr    *fs.PathError
+		linkErr    *os.LinkError
+		syscallErr *os.SyscallError
+	)
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) || errors.As(err, &syscallErr) {
+		return exitIO
+	}
+	return exitError
+}
 
-		// if a := b ; ... ?
-		if a, ok := ifn.Init.(*ast.AssignStmt); ok && len(a.Lhs) == 1 && len(a.Rhs) == 1 {
+// isSet reports whether the flag was set on the
+// command line or in the config file.
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
 
-			// if err := ?
-			if a.Lhs[0].(*ast.Ident).Name == "err" {
+// exit exits with the code unless it is exitOK so that
+// the deferred functions of main run.
+func exit(code int) {
+	if code != exitOK {
+		os.Exit(code)
+	}
+}
 
-				// if err := f(a);
-				if c, ok := a.Rhs[0].(*ast.CallExpr); ok && len(c.Args) == 1 {
+// fatal logs the arguments and exits with the code.
+func fatal(code int, v ...interface{}) {
+	log.Print(v...)
+	os.Exit(code)
+}
 
-					// if err := (test*).WaitForResult(...) ?
-					if f, ok := c.Fun.(*ast.SelectorExpr); ok && f.Sel.Name == "WaitForResult" {
+// fatalf logs the formatted message and exits with the code.
+func fatalf(code int, format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(code)
+}
 
-						switch arg0 := c.Args[0].(type) {
-						// if err := (test*).WaitForResult(someFunc); ...
-						case *ast.Ident:
-							return arg0
+// logError logs the error or all errors of an error list.
+func logError(err error) {
+	if list, ok := err.(scanner.ErrorList); ok {
+		for _, e := range list {
+			log.Print(e)
+		}
+		return
+	}
+	log.Print(err)
+}
 
-							// if err := (test*).WaitForResult(func() (bool, error) {...}); ...
-						case *ast.FuncLit:
-							return arg0.Body
+// result is the outcome of processing a single file.
+type result struct {
+	fname    string
+	n        int
+	changed  bool
+	skipped  []string
+	previews []string
+	out      []byte
+	err      error
+}
 
-						default:
-							log.Fatal("invalid WaitForResult arg type: %T", arg0)
-						}
-					}
-				}
+// processFiles processes the files with up to jobs
+// concurrent workers. Each file is transformed
+// independently and its output is buffered so that
+// the results are returned in the order of the files.
+func processFiles(files []string, jobs int) []result {
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]result, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				var buf bytes.Buffer
+				results[i] = process(files[i], nil, &buf)
+				results[i].out = buf.Bytes()
 			}
-		}
+		}()
+	}
+	for i := range files {
+		next <- i
 	}
-	return n
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// processFile transforms the file and either writes the
+// result back to the file or prints it or the diff to
+// out. In check mode nothing is written. It returns
+// the number of converted calls and reports whether the
+// transformed code differs from the original. If src is
+// not nil the source is read from src instead of the file.
+func processFile(fname string, src interface{}, out io.Writer) (n int, changed bool, err error) {
+	r := process(fname, src, out)
+	return r.n, r.changed, r.err
 }
 
-// makeForRetry creates a for loop with a retryer
-// which replaces the if stmt with testutil.WaitForResult.
-// It expects a body that is rewritten for the for loop.
-func makeForRetry(body *ast.BlockStmt) ast.Node {
-	return &ast.ForStmt{
-		Init: &ast.AssignStmt{
-			Lhs: []ast.Expr{
-				&ast.Ident{Name: "r"},
-			},
-			Tok: token.DEFINE,
-			Rhs: []ast.Expr{
-				&ast.CallExpr{
-					Fun: &ast.SelectorExpr{
-						X:   &ast.Ident{Name: "retry"},
-						Sel: &ast.Ident{Name: "OneSec"},
-					},
-				},
-			},
-		},
-		Cond: &ast.CallExpr{
-			Fun: &ast.SelectorExpr{
-				X:   &ast.Ident{Name: "r"},
-				Sel: &ast.Ident{Name: "NextOr"},
-			},
-			Args: []ast.Expr{
-				&ast.SelectorExpr{
-					X:   &ast.Ident{Name: "t"},
-					Sel: &ast.Ident{Name: "FailNow"},
-				},
-			},
-		},
-		Body: body,
+// process is processFile which returns the result
+// including the calls which were not converted.
+func process(fname string, src interface{}, out io.Writer) (r result) {
+	r.fname = fname
+	in, err := readSource(fname, src)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	// not pretty ... :(
+	if printAST {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, fname, in, parser.ParseComments)
+		if err != nil {
+			r.err = err
+			return r
+		}
+		ast.Fprint(astOutput, fset, f, ast.NotNilFilter)
+		os.Exit(0)
+	}
+
+	o := opts
+	o.Format = formatMode
+	if formatMode == "goimports" {
+		o.Format = "none"
+	}
+	o.Skipped = func(pos token.Position, reason string) {
+		r.skipped = append(r.skipped, fmt.Sprintf("%s: %s", pos, reason))
+	}
+	o.Converted = func(pos token.Position, name, before, after string) {
+		r.previews = append(r.previews, fmt.Sprintf("%s:%d: %s -> for loop\n\t- %s\n\t+ %s", pos.Filename, pos.Line, name, before, after))
+	}
+	data, n, err := transform.TransformFile(fname, in, o)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if useGoimports || formatMode == "goimports" {
+		if data, err = goimports(data); err != nil {
+			r.err = err
+			return r
+		}
 	}
+	r.n, r.changed = n, !bytes.Equal(in, data)
+	switch {
+	case check, listFiles, jsonReport, dryRun:
+		return r
+	case showDiff:
+		r.err = writeDiff(out, unifiedDiff(fname, in, data))
+		return r
+	case !write:
+		_, r.err = out.Write(data)
+		return r
+	}
+	if !r.changed {
+		return r
+	}
+	if backup {
+		if err := writeBackup(fname, in); err != nil {
+			return result{fname: fname, err: err}
+		}
+	}
+	r.err = writeFile(fname, data)
+	return r
 }
 
-// rewriteBody transforms the body of the
-// WaitForResult(func() (bool, error) {...})
-// callback.
-func rewriteBody(n ast.Node) *ast.BlockStmt {
-	body, ok := n.(*ast.BlockStmt)
-	if !ok {
-		panic("not a block stmt")
+// writeBackup writes the original content of the file to
+// file.orig with the mode of the file.
+func writeBackup(fname string, data []byte) error {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fname+".orig", data, fi.Mode().Perm()); err != nil {
+		return err
 	}
+	// the mode of an existing backup and the umask
+	return os.Chmod(fname+".orig", fi.Mode().Perm())
+}
 
-	bs := &ast.BlockStmt{}
-OUTER:
-	for _, x := range body.List {
-		switch s := x.(type) {
-		case *ast.IfStmt:
-			rewriteIf(s)
+// writeFile replaces the content of the file atomically.
+// The data is written to a temporary file in the same
+// directory which gets the mode of the original file
+// and is then renamed to it.
+func writeFile(fname string, data []byte) (err error) {
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(fname)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
 
-		case *ast.ReturnStmt:
-			bs.List = append(bs.List, rewriteReturn(s)...)
-			continue OUTER
+// reportChanged prints the names of the changed files to
+// out like gofmt -l. The errors of the files which could
+// not be transformed are printed to errOut with -e and
+// ignored otherwise.
+func reportChanged(out, errOut io.Writer, results []result) {
+	for _, r := range results {
+		if r.err != nil {
+			if !allErrors {
+				continue
+			}
+			if list, ok := r.err.(scanner.ErrorList); ok {
+				for _, e := range list {
+					fmt.Fprintln(errOut, e)
+				}
+			} else {
+				fmt.Fprintln(errOut, r.err)
+			}
+			continue
+		}
+		if r.changed {
+			fmt.Fprintln(out, r.fname)
 		}
-		bs.List = append(bs.List, x)
 	}
-	return bs
 }
 
-// rewrite return statements
+// printPreviews prints the previews of the converted
+// calls to out and logs the errors of the files.
 //
-// return true, val -> break
-// return false, val -> continue // do we have this?
-// return expr, val -> if expr { break } t.Log(val)
-func rewriteReturn(s *ast.ReturnStmt) (stmts []ast.Stmt) {
-	// ast.Print(token.NewFileSet(), s.Results)
-	switch x := s.Results[0].(type) {
-	case *ast.Ident:
-		if x.Name == "true" {
-			return []ast.Stmt{&ast.BranchStmt{Tok: token.BREAK}}
-		}
-		return []ast.Stmt{&ast.BranchStmt{Tok: token.CONTINUE}}
-
-	case *ast.BinaryExpr, *ast.CallExpr:
-		stmts = []ast.Stmt{
-			&ast.IfStmt{
-				Cond: x,
-				Body: &ast.BlockStmt{
-					List: []ast.Stmt{
-						&ast.BranchStmt{Tok: token.BREAK},
-					},
-				},
-			},
+//   foo_test.go:12: WaitForResult -> for loop
+//   	- if err := testutil.WaitForResult(func() (bool, error) {
+//   	+ for r := retry.OneSec(); r.NextOr(t.FailNow); {
+//
+func printPreviews(out io.Writer, results []result) {
+	for _, r := range results {
+		if r.err != nil {
+			logError(r.err)
+			continue
+		}
+		for _, p := range r.previews {
+			fmt.Fprintln(out, p)
 		}
+	}
+}
 
-	default:
-		log.Fatalf("unsupported result type %T", s.Results[0])
+// fileReport is the summary of a file for -json.
+type fileReport struct {
+	File      string   `json:"file"`
+	Converted int      `json:"converted"`
+	Skipped   int      `json:"skipped"`
+	Reasons   []string `json:"reasons"`
+	Errors    []string `json:"errors"`
+}
+
+// printReport prints the results as a JSON array
+// with the summary of every file to out.
+func printReport(out io.Writer, results []result) error {
+	reports := []fileReport{}
+	for _, r := range results {
+		rep := fileReport{
+			File:      r.fname,
+			Converted: r.n,
+			Skipped:   len(r.skipped),
+			Reasons:   append([]string{}, r.skipped...),
+			Errors:    []string{},
+		}
+		if list, ok := r.err.(scanner.ErrorList); ok {
+			for _, e := range list {
+				rep.Errors = append(rep.Errors, e.Error())
+			}
+		} else if r.err != nil {
+			rep.Errors = append(rep.Errors, r.err.Error())
+		}
+		reports = append(reports, rep)
 	}
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
 
-	var args []ast.Expr
-	switch x := s.Results[1].(type) {
-	case *ast.Ident:
-		if x.Name == "nil" {
-			return
+// findTestFiles returns all _test.go files in the directory
+// tree below root. The vendor and testdata directories and
+// excluded files are skipped.
+func findTestFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && (d.Name() == "vendor" || d.Name() == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, "_test.go") && !isExcluded(path) {
+			files = append(files, path)
 		}
-		args = []ast.Expr{x}
+		return nil
+	})
+	return files, err
+}
 
-	case *ast.BasicLit:
-		args = []ast.Expr{x}
+// changedTestFiles returns the _test.go files which changed
+// since the git ref and still exist. The names are relative
+// to the working directory. Excluded files are skipped.
+func changedTestFiles(ref string) ([]string, error) {
+	out, err := runGit("diff", "--name-only", "--relative", "--diff-filter=d", ref)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range strings.Split(string(out), "\n") {
+		name = strings.TrimSpace(name)
+		if strings.HasSuffix(name, "_test.go") && !isExcluded(name) {
+			files = append(files, filepath.FromSlash(name))
+		}
+	}
+	return files, nil
+}
+
+// inputFiles returns the files to transform. These are the
+// files of the arguments and the _test.go files of their
+// directories with -r or the changed files with -since
+// followed by the files of -files-from. Files which are
+// selected more than once are returned only once.
+func inputFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		if !recursive {
+			return nil, fmt.Errorf("%s is a directory. Use -r to transform it", arg)
+		}
+		names, err := findTestFiles(arg)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, names...)
+	}
 
-	case *ast.CallExpr:
-		fn := x.Fun.(*ast.SelectorExpr)
-		fname := fn.X.(*ast.Ident).Name + "." + fn.Sel.Name
-		if fname == "t.Fatalf" || fname == "fmt.Errorf" {
-			args = x.Args
+	// without git the files of the arguments are used.
+	if since != "" {
+		names, err := changedTestFiles(since)
+		if err != nil {
+			log.Printf("-since: %s. Using the files of the arguments", err)
 		} else {
-			args = []ast.Expr{x}
+			files = names
 		}
+	}
 
-	default:
-		log.Fatalf("unsupported result type %T", s.Results[1])
+	if filesFrom != "" {
+		names, err := readFileList(filesFrom)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, names...)
 	}
 
-	logf := "Logf"
-	if len(args) == 1 {
-		logf = "Log"
+	seen := map[string]bool{}
+	var uniq []string
+	for _, fname := range files {
+		if !seen[filepath.Clean(fname)] {
+			seen[filepath.Clean(fname)] = true
+			uniq = append(uniq, fname)
+		}
 	}
-	stmts = append(stmts, &ast.ExprStmt{
-		X: &ast.CallExpr{
-			Fun: &ast.SelectorExpr{
-				X:   &ast.Ident{Name: "t"},
-				Sel: &ast.Ident{Name: logf},
-			},
-			Args: args,
-		},
-	})
-	return
+	return uniq, nil
 }
 
-// rewrite if statements in the callback
-//
-// if cond { return false, fmt.Errorf(f, a) } -> if cond { t.Logf(f, a); continue }
-// if cond { return false, fmt.Errorf(f) } -> if cond { t.Log(f); continue }
-// if cond { return false, val } -> if cond { t.Log(val); continue }
-func rewriteIf(s *ast.IfStmt) {
-	n := len(s.Body.List)
-	if n == 0 {
-		return
+// readFileList returns the file names listed in the file,
+// one per line. Blank lines and lines starting with '#'
+// are skipped.
+func readFileList(fname string) ([]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
 	}
-	ret, ok := s.Body.List[n-1].(*ast.ReturnStmt)
-	if !ok || len(ret.Results) != 2 {
-		return
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
 	}
+	return files, nil
+}
 
-	// the error value
-
-	// fmt.Errorf(format) -> t.Log(format)
-	// fmt.Errorf(format, args) -> t.Logf(format, args)
-	logf := "Logf"
-	verr := ret.Results[1]
-	args := []ast.Expr{verr}
-	if ce, ok := verr.(*ast.CallExpr); ok {
-		if f, ok2 := ce.Fun.(*ast.SelectorExpr); ok2 {
-			if f.X.(*ast.Ident).Name == "fmt" && f.Sel.Name == "Errorf" {
-				args = ce.Args
-			}
+// isExcluded reports whether the base name or the full
+// path of the file match one of the exclude patterns.
+func isExcluded(path string) bool {
+	for _, pattern := range excludes {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
 		}
 	}
-	if len(args) == 1 {
-		logf = "Log"
-	}
+	return false
+}
 
-	stmts := []ast.Stmt{
-		&ast.ExprStmt{
-			X: &ast.CallExpr{
-				Fun: &ast.SelectorExpr{
-					X:   &ast.Ident{Name: "t"},
-					Sel: &ast.Ident{Name: logf},
-				},
-				Args: args,
-			},
-		},
+// readSource returns the source code from src
+// or from the file if src is nil.
+func readSource(fname string, src interface{}) ([]byte, error) {
+	switch x := src.(type) {
+	case nil:
+		return ioutil.ReadFile(fname)
+	case string:
+		return []byte(x), nil
+	case []byte:
+		return x, nil
+	case io.Reader:
+		return ioutil.ReadAll(x)
+	default:
+		return nil, fmt.Errorf("invalid source type %T", src)
 	}
+}
 
-	// return true, x -> break
-	// return false, x -> continue
-	vbool := ret.Results[0].(*ast.Ident).Name
-	if vbool == "false" {
-		stmts = append(stmts, &ast.BranchStmt{Tok: token.CONTINUE})
-	} else {
-		stmts = append(stmts, &ast.BranchStmt{Tok: token.BREAK})
+// goimports pipes the source through the goimports binary
+// which must be in the PATH.
+func goimports(src []byte) ([]byte, error) {
+	bin, err := exec.LookPath("goimports")
+	if err != nil {
+		return nil, errors.New("goimports not found in PATH")
 	}
-
-	s.Body.List = stmts
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin)
+	cmd.Stdin = bytes.NewReader(src)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("goimports: %s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
 }
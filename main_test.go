@@ -1,115 +1,825 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 )
 
-func TestRewriteBody(t *testing.T) {
+func TestGoimports(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell script")
+	}
+
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho '// goimports'\ncat\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "goimports"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("found", func(t *testing.T) {
+		t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+		got, err := goimports([]byte("package foo\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "// goimports\npackage foo\n"; string(got) != want {
+			t.Fatalf("got %q want %q", got, want)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+		if _, err := goimports([]byte("package foo\n")); err == nil {
+			t.Fatal("want error")
+		}
+	})
+}
+
+func TestFormat(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell script")
+	}
+	defer func(m string) { formatMode = m }(formatMode)
+
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho '// goimports'\ncat\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "goimports"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func helper()   int { return 1 }
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return helper() > 2, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	none := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func helper()   int { return 1 }
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if helper() > 2 {
+			break
+		}
+	}
+}
+`
+	gofmt := strings.Replace(none, "helper()   int", "helper() int", 1)
 
 	tests := []struct {
-		desc, in, out string
+		mode, out string
 	}{
-		{
-			"empty body",
-			`
-			if err := testutil.WaitForResult(func() (bool, error) {
-				return true, nil
-			}); err != nil {
-				t.Fatal(err)
-			}
-			`,
-			`
-			for r := retry.OneSec(); r.NextOr(t.FailNow); {
-				break
-			}
-			`,
-		},
-		{
-			"if with t.Fatal",
-			`
-			if err := testutil.WaitForResult(func() (bool, error) {
-				if foo == bar {
-					t.Fatal(err)
-				}
-				return true, nil
-			}); err != nil {
+		{"none", none},
+		{"gofmt", gofmt},
+		{"goimports", "// goimports\n" + none},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			formatMode = tt.mode
+			var out bytes.Buffer
+			if _, _, err := processFile("foo_test.go", in, &out); err != nil {
 				t.Fatal(err)
 			}
-			`,
-			`
-			for r := retry.OneSec(); r.NextOr(t.FailNow); {
-				if foo == bar {
-					t.Fatal(err)
-				}
-				break
+			if got := out.String(); got != tt.out {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.out)
 			}
-			`,
-		},
+		})
+	}
+}
+
+func TestStdin(t *testing.T) {
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import "github.com/hashicorp/consul/sdk/testutil/retry"
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		break
+	}
+}
+`
+	var buf bytes.Buffer
+	n, changed, err := processFile("<stdin>", strings.NewReader(src), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !changed {
+		t.Fatalf("got %d conversions changed %v", n, changed)
+	}
+	if got := buf.String(); got != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+
+	_, _, err = processFile("editor.go", "package foo\nfunc f() {", ioutil.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "editor.go:") {
+		t.Fatalf("got error %v want error for editor.go", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	defer func(w, b bool) { write, backup = w, b }(write, backup)
+	write, backup = true, true
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	unchanged := "package foo\n\nfunc TestBar(t *testing.T) {}\n"
+
+	root := t.TempDir()
+	foo, bar := filepath.Join(root, "foo_test.go"), filepath.Join(root, "bar_test.go")
+	if err := ioutil.WriteFile(foo, []byte(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bar, []byte(unchanged), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range []string{foo, bar} {
+		if _, _, err := processFile(fname, nil, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orig, err := ioutil.ReadFile(foo + ".orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(orig) != src {
+		t.Fatalf("got backup\n%s\nwant\n%s", orig, src)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(foo + ".orig")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode().Perm(), os.FileMode(0755); got != want {
+			t.Fatalf("got backup mode %v want %v", got, want)
+		}
+	}
+	data, err := ioutil.ReadFile(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "retry.OneSec()") {
+		t.Fatalf("%s: not transformed", foo)
+	}
+	if _, err := os.Stat(bar + ".orig"); !os.IsNotExist(err) {
+		t.Fatalf("got backup of unchanged file: %v", err)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+	defer func(w bool) { write = w }(write)
+	write = true
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import "github.com/hashicorp/consul/sdk/testutil/retry"
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		break
+	}
+}
+`
+	root := t.TempDir()
+	fname := filepath.Join(root, "foo_test.go")
+	if err := ioutil.WriteFile(fname, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := processFile(fname, nil, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != out {
+		t.Fatalf("got\n%s\nwant\n%s", data, out)
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Fatalf("got mode %v want %v", got, want)
+	}
+	// no temporary files are left behind
+	names, err := filepath.Glob(filepath.Join(root, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("got files %v want only %s", names, fname)
+	}
+}
+
+func TestRecursive(t *testing.T) {
+	defer func(w bool) { write = w }(write)
+	write = true
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	root := t.TempDir()
+	for _, name := range []string{
+		"a_test.go",
+		"a.go",
+		"sub/b_test.go",
+		"sub/vendor/c_test.go",
+		"testdata/d_test.go",
+	} {
+		fname := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := findTestFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "a_test.go"), filepath.Join(root, "sub/b_test.go")}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %v want %v", files, want)
+	}
+
+	for _, fname := range files {
+		_, changed, err := processFile(fname, nil, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changed {
+			t.Fatalf("%s: not changed", fname)
+		}
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "retry.OneSec()") {
+			t.Fatalf("%s: not transformed", fname)
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	defer func(w bool) { write = w }(write)
+	write = true
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	root := t.TempDir()
+	var files []string
+	for i := 0; i < 16; i++ {
+		fname := filepath.Join(root, fmt.Sprintf("f%02d_test.go", i))
+		if err := ioutil.WriteFile(fname, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fname)
+	}
+
+	results := processFiles(files, 4)
+	if got, want := len(results), len(files); got != want {
+		t.Fatalf("got %d results want %d", got, want)
+	}
+	for i, r := range results {
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.fname != files[i] {
+			t.Fatalf("result %d: got %s want %s", i, r.fname, files[i])
+		}
+		if r.n != 1 || !r.changed {
+			t.Fatalf("%s: got %d conversions changed %v", r.fname, r.n, r.changed)
+		}
+		data, err := ioutil.ReadFile(r.fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "WaitForResult") {
+			t.Fatalf("%s: not converted", r.fname)
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	defer func(w bool, e stringList) { write, excludes = w, e }(write, excludes)
+	write = true
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	root := t.TempDir()
+	for _, name := range []string{
+		"a_test.go",
+		"mock_a_test.go",
+		"legacy/b_test.go",
+	} {
+		fname := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludes = stringList{"mock_*", filepath.Join(root, "legacy", "*")}
+
+	files, err := findTestFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(root, "a_test.go")}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %v want %v", files, want)
+	}
+	for _, fname := range files {
+		if _, _, err := processFile(fname, nil, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, converted := range map[string]bool{
+		"a_test.go":        true,
+		"mock_a_test.go":   false,
+		"legacy/b_test.go": false,
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data) != src; got != converted {
+			t.Fatalf("%s: got converted %v want %v", name, got, converted)
+		}
+	}
+}
+
+func TestChangedTestFiles(t *testing.T) {
+	defer func(run func(...string) ([]byte, error), e stringList) { runGit, excludes = run, e }(runGit, excludes)
+	excludes = stringList{"mock_*"}
+
+	var args []string
+	runGit = func(a ...string) ([]byte, error) {
+		args = a
+		return []byte("a_test.go\nb.go\nmock_a_test.go\nsub/c_test.go\n"), nil
+	}
+	files, err := changedTestFiles("origin/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a_test.go", filepath.Join("sub", "c_test.go")}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %v want %v", files, want)
+	}
+	if got, want := args, []string{"diff", "--name-only", "--relative", "--diff-filter=d", "origin/main"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got git args %v want %v", got, want)
+	}
+
+	runGit = func(a ...string) ([]byte, error) {
+		return nil, fmt.Errorf("git diff: exit status 128: fatal: not a git repository")
+	}
+	if files, err := changedTestFiles("origin/main"); err == nil || files != nil {
+		t.Fatalf("got %v, %v want error", files, err)
+	}
+}
+
+func TestFilesFrom(t *testing.T) {
+	defer func(w bool) { write = w }(write)
+	write = true
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	testutil.WaitForResult(g)
+}
+`
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a_test.go"), filepath.Join(dir, "b_test.go")
+	for _, fname := range []string{a, b} {
+		if err := ioutil.WriteFile(fname, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := filepath.Join(dir, "files.txt")
+	data := "# planned files\n" + a + "\n\n  " + b + "  \n# done\n"
+	if err := ioutil.WriteFile(list, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := readFileList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{a, b}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %v want %v", files, want)
+	}
+	for _, r := range processFiles(files, 1) {
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+	}
+	for _, fname := range files {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "retry.OneSec()") {
+			t.Fatalf("%s was not transformed:\n%s", fname, data)
+		}
+	}
+
+	if _, err := readFileList(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
+
+func TestInputFiles(t *testing.T) {
+	defer func(s, f string, run func(...string) ([]byte, error)) { since, filesFrom, runGit = s, f, run }(since, filesFrom, runGit)
+
+	dir := t.TempDir()
+	arg := filepath.Join(dir, "arg_test.go")
+	if err := ioutil.WriteFile(arg, []byte("package foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filesFrom = filepath.Join(dir, "files.txt")
+	if err := ioutil.WriteFile(filesFrom, []byte("planned_test.go\nchanged_test.go\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	since = ""
+	files, err := inputFiles([]string{arg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{arg, "planned_test.go", "changed_test.go"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %v want %v", files, want)
+	}
+
+	// -since replaces the arguments but not the files of -files-from
+	since = "origin/main"
+	runGit = func(a ...string) ([]byte, error) {
+		return []byte("changed_test.go\n"), nil
+	}
+	files, err = inputFiles([]string{arg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"changed_test.go", "planned_test.go"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %v want %v", files, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	defer func(c, w bool) { check, write = c, w }(check, write)
+	check, write = true, true
+
+	files := map[string]string{
+		"clean_test.go": "package foo\n\nfunc TestFoo(t *testing.T) {}\n",
+		"dirty_test.go": `package foo
+
+func TestFoo(t *testing.T) {
+	testutil.WaitForResult(g)
+}
+`,
+	}
+	dir := t.TempDir()
+	for name, src := range files {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, changed, err := processFile(fname, nil, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := changed, name == "dirty_test.go"; got != want {
+			t.Fatalf("%s: got changed %v want %v", name, got, want)
+		}
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != src {
+			t.Fatalf("%s: file was modified", name)
+		}
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	defer func(l, e bool) { listFiles, allErrors = l, e }(listFiles, allErrors)
+	listFiles = true
+
+	files := map[string]string{
+		"clean_test.go": "package foo\n\nfunc TestFoo(t *testing.T) {}\n",
+		"dirty_test.go": `package foo
+
+func TestFoo(t *testing.T) {
+	testutil.WaitForResult(g)
+}
+`,
+		"broken_test.go": `package foo
+
+func TestFoo(t *testing.T) {
+	testutil.WaitForResult(func() (bool, error) {
+		return v.(bool), nil
+	})
+}
+`,
+	}
+	dir := t.TempDir()
+	var names []string
+	for _, name := range []string{"broken_test.go", "clean_test.go", "dirty_test.go"} {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, fname)
+	}
+
+	for _, e := range []bool{false, true} {
+		allErrors = e
+		var out, errOut bytes.Buffer
+		results := processFiles(names, 1)
+		reportChanged(&out, &errOut, results)
+		wantCode := exitChanged
+		if e {
+			wantCode = exitError
+		}
+		if code := exitCode(results, true, e); code != wantCode {
+			t.Fatalf("-e=%v: got exit code %d want %d", e, code, wantCode)
+		}
+		if got, want := out.String(), names[2]+"\n"; got != want {
+			t.Fatalf("-e=%v: got\n%s\nwant\n%s", e, got, want)
+		}
+		var want string
+		if e {
+			want = names[0] + ":5:10: unsupported result type *ast.TypeAssertExpr\n"
+		}
+		if got := errOut.String(); got != want {
+			t.Fatalf("-e=%v: got errors\n%s\nwant\n%s", e, got, want)
+		}
+	}
+	for name, src := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != src {
+			t.Fatalf("%s: file was modified", name)
+		}
+	}
+}
+
+func TestJSONReport(t *testing.T) {
+	defer func(j bool) { jsonReport = j }(jsonReport)
+	jsonReport = true
+
+	files := map[string]string{
+		"mixed_test.go": `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	errCh <- testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	})
+	go func() {
+		testutil.WaitForResult(func() (bool, error) {
+			return ready(), nil
+		})
+	}()
+}
+`,
+		"broken_test.go": `package foo
+
+func TestFoo(t *testing.T) {
+	testutil.WaitForResult(func() (bool, error) {
+		return v.(bool), nil
+	})
+}
+`,
+	}
+	dir := t.TempDir()
+	var names []string
+	for _, name := range []string{"mixed_test.go", "broken_test.go"} {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, fname)
+	}
+
+	var out bytes.Buffer
+	if err := printReport(&out, processFiles(names, 2)); err != nil {
+		t.Fatal(err)
+	}
+	var got []fileReport
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	want := []fileReport{
 		{
-			"return with binary expr",
-			`
-			if err := testutil.WaitForResult(func() (bool, error) {
-				return x > 0, "foo"
-			}); err != nil {
-				t.Fatal(err)
-			}
-			`,
-			`
-			for r := retry.OneSec(); r.NextOr(t.FailNow); {
-				if x > 0 {
-					break
-				}
-				t.Log("foo")
-			}
-			`,
+			File:      names[0],
+			Converted: 1,
+			Skipped:   2,
+			Reasons: []string{
+				names[0] + ":9:11: unsupported form",
+				names[0] + ":13:3: no *testing.T in the goroutine",
+			},
+			Errors: []string{},
 		},
 		{
-			"wfr with local fn",
-			`
-			g := func() (bool, error) { return true, nil }
-			if err := testutil.WaitForResult(g); err != nil {
-				t.Fatal(err)
-			}
-			`,
-			`
-			g := func() (bool, error) { return true, nil }
-			for r := retry.OneSec(); r.NextOr(t.FailNow); {
-				if err := g(); err != nil {
-					t.Log(err)
-					continue
-				}
-				break
-			}
-			`,
+			File:    names[1],
+			Reasons: []string{},
+			Errors:  []string{names[1] + ":5:10: unsupported result type *ast.TypeAssertExpr"},
 		},
 	}
-
-	clean := func(s string) string {
-		s = strings.Trim(s, " \n")
-		s = strings.Replace(s, "\t", "", -1)     // drop all tabs
-		s = strings.Replace(s, "\n\n", "\n", -1) // replace newlines with ;
-		s = strings.Replace(s, "\n", ";", -1)    // replace newlines with ;
-		s = strings.Replace(s, "{;", "{ ", -1)
-		s = strings.Replace(s, ";}", " }", -1)
-		s = strings.Replace(s, "};", "} ", -1)
-		s = strings.Replace(s, ";;", ";", -1)
-		return s
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+	for name, src := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != src {
+			t.Fatalf("%s: file was modified", name)
+		}
 	}
+}
+
+func TestExitCode(t *testing.T) {
+	_, ioErr := ioutil.ReadFile(filepath.Join(t.TempDir(), "missing_test.go"))
+	parseErr := fmt.Errorf("foo_test.go:1:1: expected 'package', found 'EOF'")
 
-	wrap := func(s string) string {
-		return "package foo\nfunc f() {\n" + s + "}"
+	// the rename of the temp file onto a directory fails
+	dir := filepath.Join(t.TempDir(), "dir_test.go")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
 	}
+	renameErr := writeFile(dir, []byte("package foo\n"))
+	if _, ok := renameErr.(*os.LinkError); !ok {
+		t.Fatalf("got %T want *os.LinkError", renameErr)
+	}
+
+	unchanged := result{fname: "a_test.go"}
+	changed := result{fname: "b_test.go", n: 1, changed: true}
+	failed := result{fname: "c_test.go", err: parseErr}
+	unreadable := result{fname: "missing_test.go", err: ioErr}
 
+	tests := []struct {
+		desc          string
+		results       []result
+		changes, errs bool
+		want          int
+	}{
+		{"nothing changed", []result{unchanged}, true, true, exitOK},
+		{"written", []result{unchanged, changed}, false, true, exitOK},
+		{"check", []result{unchanged, changed}, true, true, exitChanged},
+		{"transform error", []result{changed, failed}, false, true, exitError},
+		{"check with error", []result{changed, failed}, true, true, exitError},
+		{"l without e", []result{changed, failed}, true, false, exitChanged},
+		{"io error", []result{failed, unreadable, changed}, true, true, exitIO},
+		{"rename error", []result{changed, {fname: dir, err: renameErr}}, false, true, exitIO},
+	}
 	for _, tt := range tests {
-		t.Run(tt.desc, func(t *testing.T) {
-			data, err := transformFile("src.go", wrap(tt.in))
-			if err != nil {
-				t.Fatal(err)
-			}
-			if got, want := clean(string(data)), clean(wrap(tt.out)); got != want {
-				t.Fatalf("got \n%q\nwant\n%q\n", got, want)
+		if got := exitCode(tt.results, tt.changes, tt.errs); got != tt.want {
+			t.Errorf("%s: got exit code %d want %d", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	defer func(d bool) { dryRun = d }(dryRun)
+	dryRun = true
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err := testutil.WaitForResultRetries(5, func() (bool, error) {
+		for _, s := range servers {
+			if !s.Ready() {
+				return false, nil
 			}
-		})
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	fname := filepath.Join(t.TempDir(), "foo_test.go")
+	if err := ioutil.WriteFile(fname, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	printPreviews(&out, processFiles([]string{fname}, 1))
+	want := fname + ":4: WaitForResult -> for loop\n" +
+		"\t- if err := testutil.WaitForResult(func() (bool, error) {\n" +
+		"\t+ for r := retry.OneSec(); r.NextOr(t.FailNow); {\n" +
+		fname + ":9: WaitForResultRetries -> for loop\n" +
+		"\t- err := testutil.WaitForResultRetries(5, func() (bool, error) {\n" +
+		"\t+ for r := (&retry.Counter{Count: 5, Wait: 25 * time.Millisecond}); r.NextOr(t.FailNow); {\n"
+	if got := out.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != src {
+		t.Fatalf("%s: changed by -dry-run", fname)
 	}
 }
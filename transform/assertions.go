@@ -0,0 +1,160 @@
+package transform
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io"
+)
+
+// warnAssertions prints a warning to out for every call
+// of one of the assertion packages pkgs in a WaitForResult
+// callback of the packages wfrPkgs which gets the
+// *testing.T of the test. The assertion marks the test as
+// failed on the first attempt which defeats the retry. The
+// loop has no value which could take the place of the
+// *testing.T so the calls have to be fixed by hand. Only
+// NoError checks are converted if convert is set, see
+// noErrorArg.
+//
+// It has to run before the rewrite since the rewrite
+// changes the line information of the file.
+func warnAssertions(fset *token.FileSet, f *ast.File, wfrPkgs, pkgs []string, convert bool, out io.Writer) {
+	if len(pkgs) == 0 {
+		return
+	}
+	isAssertPkg := map[string]bool{}
+	for _, p := range pkgs {
+		isAssertPkg[p] = true
+	}
+	ts := testVars(f, wfrPkgs)
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		t, ok := ts[call]
+		if !ok {
+			return true
+		}
+		lit, ok := callbackArg(call).(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+		ast.Inspect(lit.Body, func(n ast.Node) bool {
+			// NoError checks are converted
+			if s, ok := n.(*ast.ExprStmt); ok && convert && noErrorArg(s, t, pkgs) != nil {
+				return false
+			}
+			c, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			// nested calls are checked on their own
+			if _, ok := ts[c]; ok {
+				return false
+			}
+			if len(c.Args) == 0 || !isIdent(c.Args[0], t) {
+				return true
+			}
+			sel, ok := c.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if pkg, ok := sel.X.(*ast.Ident); ok && isAssertPkg[pkg.Name] {
+				fmt.Fprintf(out, "%s: warning: %s.%s fails the test on the first attempt\n", fset.Position(c.Pos()), pkg.Name, sel.Sel.Name)
+			}
+			return true
+		})
+		return true
+	})
+}
+
+// attemptMethods describes the methods of the *testing.T
+// which must not be called in an attempt of the loop.
+var attemptMethods = map[string]string{
+	"Parallel": "panics on the second attempt",
+	"Run":      "runs the subtest in every attempt",
+	"Cleanup":  "registers the function in every attempt",
+	"Skip":     "skips the test in the first attempt instead of retrying",
+	"Skipf":    "skips the test in the first attempt instead of retrying",
+	"SkipNow":  "skips the test in the first attempt instead of retrying",
+}
+
+// warnTestMethods prints a warning to out for every call
+// of one of the attemptMethods of the *testing.T in a
+// WaitForResult callback of the packages wfrPkgs. The
+// calls stay on the *testing.T and have to be moved out
+// of the loop by hand.
+//
+// It has to run before the rewrite since the rewrite
+// changes the line information of the file.
+func warnTestMethods(fset *token.FileSet, f *ast.File, wfrPkgs []string, out io.Writer) {
+	ts := testVars(f, wfrPkgs)
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		t, ok := ts[call]
+		if !ok || t == "" {
+			return true
+		}
+		lit, ok := callbackArg(call).(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+		ast.Inspect(lit.Body, func(n ast.Node) bool {
+			c, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			// nested calls are checked on their own
+			if _, ok := ts[c]; ok {
+				return false
+			}
+			sel, ok := c.Fun.(*ast.SelectorExpr)
+			if !ok || !isIdent(sel.X, t) {
+				return true
+			}
+			if reason, ok := attemptMethods[sel.Sel.Name]; ok {
+				fmt.Fprintf(out, "%s: warning: %s.%s in a callback %s\n", fset.Position(c.Pos()), t, sel.Sel.Name, reason)
+			}
+			return true
+		})
+		return true
+	})
+}
+
+// noErrorArg returns the error of a statement of the form
+// 'pkg.NoError(t, err)' of one of the assertion packages
+// pkgs. The check becomes
+//
+//   if err != nil {
+//       t.Log(err)
+//       continue
+//   }
+//
+// so that the error ends the attempt instead of the test.
+// Otherwise, it returns nil.
+func noErrorArg(s *ast.ExprStmt, t string, pkgs []string) ast.Expr {
+	c, ok := s.X.(*ast.CallExpr)
+	if !ok || len(c.Args) != 2 || t == "" || types.ExprString(c.Args[0]) != t {
+		return nil
+	}
+	sel, ok := c.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "NoError" {
+		return nil
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	for _, p := range pkgs {
+		if pkg.Name == p {
+			return c.Args[1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package transform
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWarnAssertions(t *testing.T) {
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	t.Run("sub", func(st *testing.T) {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			n, err := members()
+			assert.Equal(st, 3, n)
+			require.NoError(st, err)
+			require.True(st, n > 0)
+			assert.Equal(t, 3, n)
+			check.Equal(st, 3, n)
+			return n == 3, err
+		}); err != nil {
+			st.Fatal(err)
+		}
+	})
+}
+`
+	tests := []struct {
+		pkgs string
+		want string
+	}{
+		{
+			"assert,require",
+			"foo_test.go:7:4: warning: assert.Equal fails the test on the first attempt\n" +
+				"foo_test.go:9:4: warning: require.True fails the test on the first attempt\n",
+		},
+		{"check", "foo_test.go:11:4: warning: check.Equal fails the test on the first attempt\n"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		opts := DefaultOptions()
+		opts.Warnings, opts.AssertPkgs = &buf, strings.Split(tt.pkgs, ",")
+		if _, _, err := TransformFile("foo_test.go", []byte(src), opts); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Fatalf("%q: got\n%s\nwant\n%s", tt.pkgs, got, tt.want)
+		}
+	}
+}
+
+func TestNoReceiverSwap(t *testing.T) {
+	in := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		if !ready() {
+			t.Fatal("not ready")
+		}
+		require.NoError(t, ping())
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import "github.com/hashicorp/consul/sdk/testutil/retry"
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if !ready() {
+			t.Fatal("not ready")
+		}
+		require.NoError(t, ping())
+		break
+	}
+}
+`
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.NoReceiverSwap = true
+	opts.Warnings = &buf
+	got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+	want := "foo_test.go:8:3: warning: require.NoError fails the test on the first attempt\n"
+	if buf.String() != want {
+		t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWarnTestMethods(t *testing.T) {
+	in := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		t.Parallel()
+		t.Run("sub", func(t *testing.T) {
+			t.Log("ready")
+		})
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import "github.com/hashicorp/consul/sdk/testutil/retry"
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		t.Parallel()
+		t.Run("sub", func(t *testing.T) {
+			t.Log("ready")
+		})
+		break
+	}
+}
+`
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Warnings = &buf
+	got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+	want := "foo_test.go:5:3: warning: t.Parallel in a callback panics on the second attempt\n" +
+		"foo_test.go:6:3: warning: t.Run in a callback runs the subtest in every attempt\n"
+	if buf.String() != want {
+		t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,291 @@
+package transform
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// retryPkg returns the import path of the retry package
+// which is used by the rewritten code.
+func (o Options) retryPkg() string {
+	if o.RetryPkg == "" {
+		return DefaultRetryPkg
+	}
+	return o.RetryPkg
+}
+
+// retryName returns the local name of the retry package
+// which is either the alias or the last element of the
+// import path.
+func (o Options) retryName() string {
+	if o.RetryAlias != "" {
+		return o.RetryAlias
+	}
+	return path.Base(o.retryPkg())
+}
+
+// retryImportName returns the name for the import spec
+// of the retry package or nil if the alias is not needed.
+func (o Options) retryImportName(pos token.Pos) *ast.Ident {
+	if o.RetryAlias == "" || o.RetryAlias == path.Base(o.retryPkg()) {
+		return nil
+	}
+	return &ast.Ident{NamePos: pos, Name: o.RetryAlias}
+}
+
+// fixImports removes the testutil import tu if the file
+// no longer references it after the rewrite and adds
+// the retry import if the rewritten code uses it.
+// It also adds the time import if the rewritten code
+// refers to time.Duration constants and removes the
+// imports which were used before the rewrite and are
+// no longer used, e.g. fmt after fmt.Errorf became
+// t.Logf or the context of a dropped callback parameter.
+//
+// If the testutil import is replaced by the retry import
+// the new import takes its place to preserve the grouping
+// of the import block.
+func fixImports(f *ast.File, opts Options, tu *ast.ImportSpec, before map[*ast.ImportSpec]bool) {
+	used := tu != nil && usesPkg(f, importName(tu))
+	if dot := findDotImport(f, "testutil"); tu == nil && dot != nil {
+		tu, used = dot, usesDotImport(f)
+	}
+	needRetry := usesPkg(f, opts.retryName()) && findImport(f, opts.retryName()) == nil
+
+	switch {
+	case tu != nil && !used && needRetry:
+		tu.Name = opts.retryImportName(tu.Pos())
+		tu.Path.Value = strconv.Quote(opts.retryPkg())
+
+	case tu != nil && !used:
+		deleteImport(f, tu)
+
+	case needRetry:
+		addImport(f, opts.retryImportName(token.NoPos), opts.retryPkg(), tu)
+	}
+
+	if usesPkg(f, "time") && findImport(f, "time") == nil {
+		addImport(f, nil, "time", nil)
+	}
+
+	for _, imp := range append([]*ast.ImportSpec(nil), f.Imports...) {
+		if before[imp] && !usesPkg(f, importName(imp)) {
+			deleteImport(f, imp)
+		}
+	}
+}
+
+// wfrImport returns the import of the package of the
+// WaitForResult calls, e.g. tu for tu.WaitForResult, or
+// nil if the calls are not qualified by an imported
+// package.
+func wfrImport(f *ast.File, pkgs []string) *ast.ImportSpec {
+	var imp *ast.ImportSpec
+	ast.Inspect(f, func(n ast.Node) bool {
+		if imp != nil {
+			return false
+		}
+		call, ok := n.(*ast.CallExpr)
+		if !ok || wfrCall(call, pkgs) == nil {
+			return true
+		}
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok {
+				imp = findImport(f, x.Name)
+			}
+		}
+		return true
+	})
+	return imp
+}
+
+// usedImports returns the imports of the file which
+// are referenced by a selector expression. Dot and
+// blank imports are not included.
+func usedImports(f *ast.File) map[*ast.ImportSpec]bool {
+	used := map[*ast.ImportSpec]bool{}
+	for _, imp := range f.Imports {
+		if name := importName(imp); name != "." && name != "_" && usesPkg(f, name) {
+			used[imp] = true
+		}
+	}
+	return used
+}
+
+// importName returns the local name of the imported package.
+func importName(s *ast.ImportSpec) string {
+	if s.Name != nil {
+		return s.Name.Name
+	}
+	p, err := strconv.Unquote(s.Path.Value)
+	if err != nil {
+		return ""
+	}
+	return path.Base(p)
+}
+
+// findImport returns the import spec for the package
+// with the given local name or nil.
+func findImport(f *ast.File, name string) *ast.ImportSpec {
+	for _, s := range f.Imports {
+		if importName(s) == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// findDotImport returns the dot-import spec for
+// the package with the given name or nil.
+func findDotImport(f *ast.File, name string) *ast.ImportSpec {
+	for _, s := range f.Imports {
+		if s.Name == nil || s.Name.Name != "." {
+			continue
+		}
+		if p, err := strconv.Unquote(s.Path.Value); err == nil && path.Base(p) == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// usesDotImport reports whether the file still contains
+// unresolved identifiers other than package names which
+// may refer to a dot-imported package. Since the parser
+// cannot tell whether they are declared in another file
+// of the package this errs on the side of keeping the
+// import.
+func usesDotImport(f *ast.File) bool {
+	unresolved := map[*ast.Ident]bool{}
+	for _, id := range f.Unresolved {
+		if types.Universe.Lookup(id.Name) == nil && findImport(f, id.Name) == nil {
+			unresolved[id] = true
+		}
+	}
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && unresolved[id] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// usesPkg reports whether the file contains
+// a selector expression of the form name.X.
+func usesPkg(f *ast.File, name string) bool {
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if found {
+			return false
+		}
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == name {
+				found = true
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// isStdImport reports whether the import spec
+// refers to a standard library package.
+func isStdImport(s *ast.ImportSpec) bool {
+	p, err := strconv.Unquote(s.Path.Value)
+	return err == nil && isStdPath(p)
+}
+
+// isStdPath reports whether the import path refers to a
+// standard library package, i.e. its first element has no dot.
+func isStdPath(p string) bool {
+	return !strings.Contains(strings.SplitN(p, "/", 2)[0], ".")
+}
+
+// deleteImport removes the import spec from the file.
+// The import declaration is removed if it becomes empty.
+func deleteImport(f *ast.File, imp *ast.ImportSpec) {
+	for i, s := range f.Imports {
+		if s == imp {
+			f.Imports = append(f.Imports[:i], f.Imports[i+1:]...)
+			break
+		}
+	}
+
+	for i, d := range f.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		for j, s := range gd.Specs {
+			if s != imp {
+				continue
+			}
+			gd.Specs = append(gd.Specs[:j], gd.Specs[j+1:]...)
+			if len(gd.Specs) == 0 {
+				f.Decls = append(f.Decls[:i], f.Decls[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// addImport adds an import for the package path with an
+// optional local name. The new import is added after the
+// spec 'after' if it is not nil. Otherwise, it is added
+// after the last import of the same kind (standard library
+// or not) in the first import declaration or a new import
+// declaration is created.
+func addImport(f *ast.File, name *ast.Ident, pkg string, after *ast.ImportSpec) {
+	var decl *ast.GenDecl
+	idx := -1
+	for _, d := range f.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		if decl == nil {
+			decl, idx = gd, len(gd.Specs)-1
+			if after == nil {
+				for j, s := range gd.Specs {
+					if isStdImport(s.(*ast.ImportSpec)) == isStdPath(pkg) {
+						idx = j
+					}
+				}
+			}
+		}
+		for j, s := range gd.Specs {
+			if s == after {
+				decl, idx = gd, j
+			}
+		}
+	}
+
+	imp := &ast.ImportSpec{Name: name, Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(pkg)}}
+	f.Imports = append(f.Imports, imp)
+
+	if decl == nil {
+		decl = &ast.GenDecl{Tok: token.IMPORT, Specs: []ast.Spec{imp}}
+		f.Decls = append([]ast.Decl{decl}, f.Decls...)
+		return
+	}
+
+	// place the new import on the same line as its
+	// predecessor so that it is sorted into the same
+	// group by the formatter.
+	pos := decl.Specs[idx].Pos()
+	if imp.Name != nil {
+		imp.Name.NamePos = pos
+	}
+	imp.Path.ValuePos = pos
+	imp.EndPos = pos
+	if !decl.Lparen.IsValid() {
+		decl.Lparen = decl.Specs[0].Pos()
+	}
+	decl.Specs = append(decl.Specs[:idx+1], append([]ast.Spec{imp}, decl.Specs[idx+1:]...)...)
+}
@@ -0,0 +1,324 @@
+package transform
+
+import (
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestRetryPkg(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	tests := []struct {
+		desc, pkg, alias, out string
+	}{
+		{
+			"custom pkg", "example.com/internal/retrier", "",
+			`package foo
+
+import (
+	"testing"
+
+	"example.com/internal/retrier"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retrier.OneSec(); r.NextOr(t.FailNow); {
+		break
+	}
+}
+`,
+		},
+		{
+			"custom alias", "example.com/internal/retry/v2", "retry",
+			`package foo
+
+import (
+	"testing"
+
+	retry "example.com/internal/retry/v2"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		break
+	}
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.RetryPkg, opts.RetryAlias = tt.pkg, tt.alias
+			data, _, err := TransformFile("src.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(data), tt.out; got != want {
+				t.Fatalf("got \n%s\nwant\n%s\n", got, want)
+			}
+		})
+	}
+}
+
+func TestFixImports(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      string
+		imports []string
+	}{
+		{
+			"testutil only used for WaitForResult",
+			`package foo
+
+			import (
+				"testing"
+
+				"github.com/hashicorp/consul/testutil"
+			)
+
+			func TestFoo(t *testing.T) {
+				if err := testutil.WaitForResult(func() (bool, error) {
+					return true, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			`,
+			[]string{"testing", "github.com/hashicorp/consul/sdk/testutil/retry"},
+		},
+		{
+			"testutil still used",
+			`package foo
+
+			import (
+				"testing"
+
+				"github.com/hashicorp/consul/testutil"
+			)
+
+			func TestFoo(t *testing.T) {
+				testutil.TempDir(t, "foo")
+				if err := testutil.WaitForResult(func() (bool, error) {
+					return true, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			`,
+			[]string{"testing", "github.com/hashicorp/consul/sdk/testutil/retry", "github.com/hashicorp/consul/testutil"},
+		},
+		{
+			"retry already imported",
+			`package foo
+
+			import (
+				"testing"
+
+				"github.com/hashicorp/consul/sdk/testutil/retry"
+				"github.com/hashicorp/consul/testutil"
+			)
+
+			func TestFoo(t *testing.T) {
+				for r := retry.OneSec(); r.NextOr(t.FailNow); {
+					break
+				}
+				if err := testutil.WaitForResult(func() (bool, error) {
+					return true, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			`,
+			[]string{"testing", "github.com/hashicorp/consul/sdk/testutil/retry"},
+		},
+
+		{
+			"dot-imported testutil only used for WaitForResult",
+			`package foo
+
+			import (
+				"testing"
+
+				. "github.com/hashicorp/consul/testutil"
+			)
+
+			func TestFoo(t *testing.T) {
+				if err := WaitForResult(func() (bool, error) {
+					return true, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			`,
+			[]string{"testing", "github.com/hashicorp/consul/sdk/testutil/retry"},
+		},
+		{
+			"fmt and errors only used in the callback",
+			`package foo
+
+			import (
+				"errors"
+				"fmt"
+				"testing"
+
+				"github.com/hashicorp/consul/testutil"
+			)
+
+			func TestFoo(t *testing.T) {
+				if err := testutil.WaitForResult(func() (bool, error) {
+					if !ready() {
+						return false, errors.New("not ready")
+					}
+					return leader() != "", fmt.Errorf("no leader")
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			`,
+			[]string{"testing", "github.com/hashicorp/consul/sdk/testutil/retry"},
+		},
+		{
+			"fmt still used",
+			`package foo
+
+			import (
+				"fmt"
+				"testing"
+
+				"github.com/hashicorp/consul/testutil"
+			)
+
+			func TestFoo(t *testing.T) {
+				if err := testutil.WaitForResult(func() (bool, error) {
+					return leader() != "", fmt.Errorf("no leader")
+				}); err != nil {
+					t.Fatal(err)
+				}
+				fmt.Println("done")
+			}
+			`,
+			[]string{"fmt", "testing", "github.com/hashicorp/consul/sdk/testutil/retry"},
+		},
+		{
+			"dot-imported testutil still used",
+			`package foo
+
+			import (
+				"testing"
+
+				. "github.com/hashicorp/consul/testutil"
+			)
+
+			func TestFoo(t *testing.T) {
+				TempDir(t, "foo")
+				if err := WaitForResult(func() (bool, error) {
+					return true, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			`,
+			[]string{"testing", "github.com/hashicorp/consul/sdk/testutil/retry", "github.com/hashicorp/consul/testutil"},
+		},
+		{
+			"no imports",
+			`package foo
+
+			func f(t *testing.T) {
+				if err := testutil.WaitForResult(func() (bool, error) {
+					return true, nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			`,
+			[]string{"github.com/hashicorp/consul/sdk/testutil/retry"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			data, _, err := TransformFile("src.go", []byte(tt.in), DefaultOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := parser.ParseFile(token.NewFileSet(), "src.go", data, parser.ImportsOnly)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range f.Imports {
+				p, _ := strconv.Unquote(s.Path.Value)
+				got = append(got, p)
+			}
+			if want := tt.imports; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAliasedTestutil(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	tu "github.com/hashicorp/consul/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFoo(t *testing.T) {
+	if err := tu.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	require.True(t, true)
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		break
+	}
+	require.True(t, true)
+}
+`
+	got, _, err := TransformFile("foo_test.go", []byte(in), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
@@ -0,0 +1,217 @@
+package transform
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// mergeLoops merges adjacent generated loops with the same
+// retryer into a single loop which checks the conditions of
+// both callbacks in every attempt.
+//
+//   for r := retry.OneSec(); r.NextOr(t.FailNow); {
+//       if leader() != "" {
+//           break
+//       }
+//   }
+//   for r := retry.OneSec(); r.NextOr(t.FailNow); {
+//       if ready() {
+//           break
+//       }
+//   }
+//
+// becomes
+//
+//   for r := retry.OneSec(); r.NextOr(t.FailNow); {
+//       if leader() == "" {
+//           continue
+//       }
+//       if ready() {
+//           break
+//       }
+//   }
+//
+// The loops are only merged if the first one ends with a
+// break or a conditional break and does not break anywhere
+// else and if the second one does not use the variables
+// which are declared by the first one.
+func (w *rewriter) mergeLoops(f *ast.File) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		if list := stmtList(n); list != nil {
+			*list = w.mergeList(*list)
+		}
+		return true
+	})
+}
+
+// mergeList merges the adjacent loops of the statement list.
+func (w *rewriter) mergeList(list []ast.Stmt) []ast.Stmt {
+	for i := 0; i+1 < len(list); {
+		a, ok := w.generated(list[i])
+		if !ok {
+			i++
+			continue
+		}
+		b, ok := w.generated(list[i+1])
+		if !ok || !sameRetryer(a, b) || !mergeable(a.Body, b.Body) {
+			i++
+			continue
+		}
+		w.logf(a.Pos(), "merged with the loop in line %d", w.position(b.Pos()).Line)
+		a.Body.List = append(endAttempt(a.Body.List), b.Body.List...)
+		a.Body.Rbrace = b.Body.Rbrace
+		delete(w.depth, b)
+		list = append(list[:i+1], list[i+2:]...)
+	}
+	return list
+}
+
+// generated returns the statement if it is a loop which
+// was generated by the rewrite.
+func (w *rewriter) generated(s ast.Stmt) (*ast.ForStmt, bool) {
+	loop, ok := s.(*ast.ForStmt)
+	if !ok {
+		return nil, false
+	}
+	_, ok = w.depth[loop]
+	return loop, ok
+}
+
+// sameRetryer reports whether both loops use the same
+// retryer and fail the same test.
+func sameRetryer(a, b *ast.ForStmt) bool {
+	ra, rb := a.Init.(*ast.AssignStmt).Rhs[0], b.Init.(*ast.AssignStmt).Rhs[0]
+	return types.ExprString(ra) == types.ExprString(rb) && types.ExprString(a.Cond) == types.ExprString(b.Cond)
+}
+
+// mergeable reports whether the second loop body can
+// follow the first one in the same loop.
+func mergeable(a, b *ast.BlockStmt) bool {
+	if len(a.List) == 0 {
+		return false
+	}
+	last := a.List[len(a.List)-1]
+	if !isBreak(last) && !isBreakIf(last) {
+		return false
+	}
+	for _, s := range a.List[:len(a.List)-1] {
+		if breaksLoop(s) {
+			return false
+		}
+	}
+	for _, s := range a.List {
+		for _, name := range declaredNames(s) {
+			if refersTo(b, name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// endAttempt returns the statements of the first loop body
+// with the final break removed so that the statements of
+// the second loop body follow. A final 'if cond { break }'
+// becomes 'if !cond { continue }'.
+func endAttempt(list []ast.Stmt) []ast.Stmt {
+	last := list[len(list)-1]
+	if isBreak(last) {
+		return list[:len(list)-1]
+	}
+	ifn := last.(*ast.IfStmt)
+	ifn.Cond = negate(ifn.Cond)
+	ifn.Body.List[0].(*ast.BranchStmt).Tok = token.CONTINUE
+	return list
+}
+
+// isBreak checks if the statement is an unlabeled break.
+func isBreak(s ast.Stmt) bool {
+	b, ok := s.(*ast.BranchStmt)
+	return ok && b.Tok == token.BREAK && b.Label == nil
+}
+
+// isBreakIf checks if the statement is 'if cond { break }'.
+func isBreakIf(s ast.Stmt) bool {
+	ifn, ok := s.(*ast.IfStmt)
+	return ok && ifn.Init == nil && ifn.Else == nil && len(ifn.Body.List) == 1 && isBreak(ifn.Body.List[0])
+}
+
+// breaksLoop reports whether the statement contains a break
+// of the enclosing loop or a labeled branch statement.
+func breaksLoop(s ast.Stmt) bool {
+	found := false
+	ast.Inspect(s, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			// their unlabeled breaks end them
+			ast.Inspect(x, func(n ast.Node) bool {
+				if b, ok := n.(*ast.BranchStmt); ok && b.Label != nil {
+					found = true
+				}
+				return !found
+			})
+			return false
+		case *ast.BranchStmt:
+			found = found || x.Label != nil || x.Tok == token.BREAK
+		}
+		return !found
+	})
+	return found
+}
+
+// declaredNames returns the names which are declared
+// by the statement in the enclosing block.
+func declaredNames(s ast.Stmt) []string {
+	var names []string
+	switch x := s.(type) {
+	case *ast.AssignStmt:
+		if x.Tok == token.DEFINE {
+			for _, id := range x.Lhs {
+				if id, ok := id.(*ast.Ident); ok && id.Name != "_" {
+					names = append(names, id.Name)
+				}
+			}
+		}
+	case *ast.DeclStmt:
+		if d, ok := x.Decl.(*ast.GenDecl); ok {
+			for _, spec := range d.Specs {
+				switch sp := spec.(type) {
+				case *ast.ValueSpec:
+					for _, id := range sp.Names {
+						names = append(names, id.Name)
+					}
+				case *ast.TypeSpec:
+					names = append(names, sp.Name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// negate returns the negated condition.
+func negate(cond ast.Expr) ast.Expr {
+	switch x := cond.(type) {
+	case *ast.UnaryExpr:
+		if x.Op == token.NOT {
+			return x.X
+		}
+	case *ast.BinaryExpr:
+		inverse := map[token.Token]token.Token{
+			token.EQL: token.NEQ,
+			token.NEQ: token.EQL,
+			token.LSS: token.GEQ,
+			token.GEQ: token.LSS,
+			token.GTR: token.LEQ,
+			token.LEQ: token.GTR,
+		}
+		if op, ok := inverse[x.Op]; ok {
+			return &ast.BinaryExpr{X: x.X, OpPos: x.OpPos, Op: op, Y: x.Y}
+		}
+		return &ast.UnaryExpr{OpPos: x.Pos(), Op: token.NOT, X: &ast.ParenExpr{Lparen: x.Pos(), X: x, Rparen: x.End()}}
+	}
+	return &ast.UnaryExpr{OpPos: cond.Pos(), Op: token.NOT, X: cond}
+}
@@ -0,0 +1,157 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeAdjacent(t *testing.T) {
+	tests := []struct {
+		desc, in, out string
+	}{
+		{
+			"back to back",
+			`
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return leader() != "", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		if err := ping(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+`,
+			`
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if leader() == "" {
+			continue
+		}
+
+		if err := ping(); err != nil {
+			t.Log(err)
+			continue
+		}
+
+		if ready() {
+			break
+		}
+	}
+`,
+		},
+		{
+			"shared variables",
+			`
+	if err := testutil.WaitForResult(func() (bool, error) {
+		n := len(members())
+		return n == 3, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return n == 0, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+`,
+			`
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		n := len(members())
+		if n == 3 {
+			break
+		}
+	}
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if n == 0 {
+			break
+		}
+	}
+`,
+		},
+		{
+			"early break",
+			`
+	if err := testutil.WaitForResult(func() (bool, error) {
+		if cached() {
+			return true, nil
+		}
+		return refresh(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+`,
+			`
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if cached() {
+			break
+		}
+		if refresh() {
+			break
+		}
+	}
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+`,
+		},
+		{
+			"different retryers",
+			`
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return leader() != "", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.WaitForResultRetries(10, func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+`,
+			`
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if leader() != "" {
+			break
+		}
+	}
+	for r := (&retry.Counter{Count: 10, Wait: 25 * time.Millisecond}); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			in := "package foo\n\nfunc TestFoo(t *testing.T) {" + tt.in + "}\n"
+			opts := DefaultOptions()
+			opts.MergeAdjacent = true
+			opts.Format = "gofmt"
+			got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := "func TestFoo(t *testing.T) {" + tt.out + "}\n"
+			if !strings.HasSuffix(string(got), out) {
+				t.Fatalf("got\n%s\nwant\n%s", got, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package transform
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+)
+
+// warnOuterState prints a warning to out for every variable which
+// is declared outside of a WaitForResult callback and
+// modified inside of it. The callback runs on every attempt
+// and so do the modifications which is easy to miss once
+// the callback has become the body of a loop.
+//
+// It has to run before the rewrite since the rewrite
+// changes the line information of the file.
+func warnOuterState(fset *token.FileSet, f *ast.File, pkgs []string, out io.Writer) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		c, ok := n.(*ast.CallExpr)
+		if !ok || wfrCall(c, pkgs) == nil {
+			return true
+		}
+		lit, ok := callbackArg(c).(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+		for _, id := range outerMutations(lit) {
+			fmt.Fprintf(out, "%s: warning: callback modifies outer variable %s\n", fset.Position(id.Pos()), id.Name)
+		}
+		return true
+	})
+}
+
+// outerMutations returns the first identifier of every
+// variable declared outside of the function literal which
+// is assigned, incremented or decremented in its body.
+func outerMutations(lit *ast.FuncLit) []*ast.Ident {
+	var ids []*ast.Ident
+	seen := map[string]bool{}
+	add := func(x ast.Expr) {
+		id := rootIdent(x)
+		if id == nil || id.Name == "_" || seen[id.Name] || isLocal(id, lit) {
+			return
+		}
+		seen[id.Name] = true
+		ids = append(ids, id)
+	}
+	ast.Inspect(lit.Body, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			if x.Tok == token.DEFINE {
+				return true
+			}
+			for _, lhs := range x.Lhs {
+				add(lhs)
+			}
+		case *ast.IncDecStmt:
+			add(x.X)
+		}
+		return true
+	})
+	return ids
+}
+
+// rootIdent returns the variable of an assignable
+// expression like x, x.f, x[i] or *x or nil.
+func rootIdent(x ast.Expr) *ast.Ident {
+	for {
+		switch e := x.(type) {
+		case *ast.Ident:
+			return e
+		case *ast.SelectorExpr:
+			x = e.X
+		case *ast.IndexExpr:
+			x = e.X
+		case *ast.StarExpr:
+			x = e.X
+		case *ast.ParenExpr:
+			x = e.X
+		default:
+			return nil
+		}
+	}
+}
+
+// isLocal reports whether the identifier is declared
+// within the function literal including its parameters.
+// Unresolved identifiers are package level variables
+// and therefore not local.
+func isLocal(id *ast.Ident, lit *ast.FuncLit) bool {
+	if id.Obj == nil {
+		return false
+	}
+	d, ok := id.Obj.Decl.(ast.Node)
+	return ok && d.Pos() >= lit.Pos() && d.End() <= lit.End()
+}
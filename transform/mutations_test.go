@@ -0,0 +1,43 @@
+package transform
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWarnOuterState(t *testing.T) {
+	src := `package foo
+
+var total int
+
+func TestFoo(t *testing.T) {
+	count := 0
+	var s state
+	if err := testutil.WaitForResult(func() (bool, error) {
+		count++
+		total += 1
+		s.n = count
+		n, err := members()
+		n++
+		for i := 0; i < n; i++ {
+			count++
+		}
+		return n > 3, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Warnings = &buf
+	if _, _, err := TransformFile("foo_test.go", []byte(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	want := "foo_test.go:9:3: warning: callback modifies outer variable count\n" +
+		"foo_test.go:10:3: warning: callback modifies outer variable total\n" +
+		"foo_test.go:11:3: warning: callback modifies outer variable s\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
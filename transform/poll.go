@@ -0,0 +1,195 @@
+package transform
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"time"
+
+	"github.com/magiconair/wfr2retry/apply"
+)
+
+// The defaults of poll.WaitOn.
+const (
+	pollTimeout = 10 * time.Second
+	pollDelay   = 100 * time.Millisecond
+)
+
+// hasPoll reports whether the file contains
+// a poll.WaitOn call.
+func hasPoll(f *ast.File) bool {
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if x, ok := n.(ast.Expr); ok && pollCall(x) != nil {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// pollCall returns the call expression if the expression
+// is a call of the form poll.WaitOn(t, check, ops...) of
+// the gotest.tools poll package. Otherwise, it returns nil.
+func pollCall(x ast.Expr) *ast.CallExpr {
+	c, ok := x.(*ast.CallExpr)
+	if !ok || len(c.Args) < 2 || callName(c) != "poll.WaitOn" {
+		return nil
+	}
+	return c
+}
+
+// rewritePoll converts a poll.WaitOn call with a function
+// literal as check to a for loop with a retry.Timer. The
+// timeout and the delay of the options are used for the
+// timer.
+//
+//   poll.WaitOn(t, func(logt poll.LogT) poll.Result {
+//       if !ready() {
+//           return poll.Continue("not ready")
+//       }
+//       return poll.Success()
+//   }, poll.WithTimeout(5*time.Second))
+//
+// becomes
+//
+//   for r := (&retry.Timer{Timeout: 5 * time.Second, Wait: 100 * time.Millisecond}); r.NextOr(t.FailNow); {
+//       if !ready() {
+//           t.Log("not ready")
+//           continue
+//       }
+//       break
+//   }
+//
+func (w *rewriter) rewritePoll(c apply.ApplyCursor, call *ast.CallExpr) bool {
+	lit, ok := call.Args[1].(*ast.FuncLit)
+	if !ok {
+		w.skip(call, c.Node(), "unsupported form")
+		return false
+	}
+	timeout, delay := makeDuration(pollTimeout), makeDuration(pollDelay)
+	for _, op := range call.Args[2:] {
+		x, ok := op.(*ast.CallExpr)
+		if !ok || len(x.Args) != 1 {
+			w.skip(call, c.Node(), "unsupported form")
+			return false
+		}
+		switch callName(x) {
+		case "poll.WithTimeout":
+			timeout = x.Args[0]
+		case "poll.WithDelay":
+			delay = x.Args[0]
+		default:
+			w.skip(call, c.Node(), "unsupported form")
+			return false
+		}
+	}
+	w.logf(call.Pos(), "poll.WaitOn call matched")
+	before := w.source(c.Node())
+
+	w.t = types.ExprString(call.Args[0])
+	w.loops, w.switches, w.label = 0, 0, nil
+	w.poll = true
+	body := w.rewriteBody(lit.Body)
+	w.poll = false
+	if body == nil {
+		return false
+	}
+	// the *testing.T takes the place of the poll.LogT
+	if p := lit.Type.Params; p.NumFields() == 1 && len(p.List[0].Names) == 1 {
+		if name := p.List[0].Names[0]; name.Name != "_" && refersTo(body, name.Name) {
+			body.List = append([]ast.Stmt{&ast.AssignStmt{
+				Lhs: []ast.Expr{&ast.Ident{NamePos: lit.Body.Lbrace, Name: name.Name}},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{testExpr(lit.Body.Lbrace, w.t)},
+			}}, body.List...)
+		}
+	}
+	retryer := w.makeRetryLit("Timer",
+		&ast.KeyValueExpr{Key: &ast.Ident{Name: "Timeout"}, Value: timeout},
+		&ast.KeyValueExpr{Key: &ast.Ident{Name: "Wait"}, Value: delay},
+	)
+	w.replaceWithLoop(c, call.Pos(), "poll.WaitOn", retryer, body, before)
+	return true
+}
+
+// rewrite return statements of a poll.WaitOn check
+//
+// return poll.Success() -> break
+// return poll.Continue(f, args...) -> t.Logf(f, args...); continue
+// return poll.Error(err) -> t.Fatal(err)
+func (w *rewriter) rewritePollReturn(s *ast.ReturnStmt) []ast.Stmt {
+	pos := s.Pos()
+	var c *ast.CallExpr
+	if len(s.Results) == 1 {
+		c, _ = s.Results[0].(*ast.CallExpr)
+	}
+	if c == nil {
+		w.errorf(pos, "unsupported poll result")
+		return []ast.Stmt{s}
+	}
+	logCall := func(name string, args []ast.Expr) ast.Stmt {
+		return &ast.ExprStmt{
+			X: &ast.CallExpr{
+				Fun:  &ast.SelectorExpr{X: testExpr(pos, w.t), Sel: &ast.Ident{Name: name}},
+				Args: args,
+			},
+		}
+	}
+	switch callName(c) {
+	case "poll.Success":
+		return []ast.Stmt{&ast.BranchStmt{TokPos: pos, Tok: token.BREAK}}
+	case "poll.Continue":
+		name := "Logf"
+		if len(c.Args) == 1 && !hasVerb(c.Args) {
+			name = "Log"
+		}
+		return []ast.Stmt{logCall(name, c.Args), &ast.BranchStmt{TokPos: pos, Tok: token.CONTINUE}}
+	case "poll.Error":
+		return []ast.Stmt{logCall("Fatal", c.Args)}
+	}
+	w.errorf(pos, "unsupported poll result %s", types.ExprString(c.Fun))
+	return []ast.Stmt{s}
+}
+
+// isFatal checks if the statement is a call of
+// t.Fatal which ends the test.
+func (w *rewriter) isFatal(s ast.Stmt) bool {
+	x, ok := s.(*ast.ExprStmt)
+	if !ok {
+		return false
+	}
+	c, ok := x.X.(*ast.CallExpr)
+	return ok && types.ExprString(c.Fun) == w.t+".Fatal"
+}
+
+// matches reports whether the calls of the form are
+// converted. The forms are
+//
+//   waitforresult: (test*).WaitForResult(...)
+//   pollwaiton:    poll.WaitOn(...)
+//
+func (o Options) matches(form string) bool {
+	if len(o.Match) == 0 {
+		return form == "waitforresult"
+	}
+	for _, m := range o.Match {
+		if m == form {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMatch returns an error for unknown forms.
+func checkMatch(forms []string) error {
+	for _, m := range forms {
+		switch m {
+		case "waitforresult", "pollwaiton":
+		default:
+			return fmt.Errorf("invalid match %q", m)
+		}
+	}
+	return nil
+}
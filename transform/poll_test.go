@@ -0,0 +1,79 @@
+package transform
+
+import (
+	"testing"
+)
+
+func TestPoll(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/poll"
+)
+
+func TestFoo(t *testing.T) {
+	poll.WaitOn(t, func(logt poll.LogT) poll.Result {
+		n, err := members()
+		if err != nil {
+			return poll.Error(err)
+		}
+		if n != 3 {
+			logt.Logf("got %d members", n)
+			return poll.Continue("waiting for %d members", 3)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second))
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	logt := t
+	for r := (&retry.Timer{Timeout: 5 * time.Second, Wait: 100 * time.Millisecond}); r.NextOr(t.FailNow); {
+		n, err := members()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			logt.Logf("got %d members", n)
+			t.Logf("waiting for %d members", 3)
+			continue
+		}
+		break
+	}
+}
+`
+	tests := []struct {
+		desc  string
+		match []string
+		out   string
+	}{
+		{"default", nil, in},
+		{"pollwaiton", []string{"waitforresult", "pollwaiton"}, out},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			opts := DefaultOptions()
+			if tt.match != nil {
+				opts.Match = tt.match
+			}
+			got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.out {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.out)
+			}
+		})
+	}
+}
@@ -0,0 +1,1887 @@
+package transform
+
+import (
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magiconair/wfr2retry/apply"
+)
+
+// rewriter holds the state for rewriting a single file.
+type rewriter struct {
+	fset *token.FileSet
+	file *ast.File
+	opts Options
+
+	// orig has the line information of the file before the
+	// rewrite which merges lines of removed code. It is used
+	// to report positions.
+	orig *token.FileSet
+
+	// depth is the nesting depth of the generated loops.
+	depth map[*ast.ForStmt]int
+
+	// errs collects the errors for unsupported constructs
+	// so that all of them can be reported at once.
+	errs scanner.ErrorList
+
+	// results is the number of results of the
+	// callback which is currently rewritten.
+	results int
+
+	// boolResult is true if the callback which is
+	// currently rewritten returns only a bool.
+	boolResult bool
+
+	// named are the names of the results of the callback
+	// which is currently rewritten or nil if they are
+	// unnamed.
+	named []*ast.Ident
+
+	// testVars maps the WaitForResult calls to the name of
+	// the *testing.T of the enclosing test or subtest.
+	testVars map[*ast.CallExpr]string
+
+	// t is the name of the *testing.T of the call
+	// which is currently rewritten.
+	t string
+
+	// loops and switches are the number of for and of
+	// switch and select statements of the callback around
+	// the statements which are currently rewritten. Their
+	// break and continue statements need the label of the
+	// loop.
+	loops, switches int
+
+	// poll is true if the check of a poll.WaitOn call
+	// is rewritten.
+	poll bool
+
+	// label is the label of the loop which is currently
+	// generated or nil if it does not need one.
+	label *ast.Ident
+
+	// labels are the labels of the file. Labels must be
+	// unique within a function.
+	labels map[string]bool
+}
+
+// newRewriter creates a rewriter for the file.
+func newRewriter(fset *token.FileSet, f *ast.File, opts Options) *rewriter {
+	tf := fset.File(f.Pos())
+	orig := token.NewFileSet()
+	// copy the lines since MergeLine modifies them in place
+	lines := append([]int(nil), tf.Lines()...)
+	orig.AddFile(tf.Name(), tf.Base(), tf.Size()).SetLines(lines)
+	labels := map[string]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if x, ok := n.(*ast.LabeledStmt); ok {
+			labels[x.Label.Name] = true
+		}
+		return true
+	})
+	return &rewriter{fset: fset, file: f, opts: opts, orig: orig, depth: map[*ast.ForStmt]int{}, testVars: testVars(f, opts.Packages), labels: labels}
+}
+
+// testVars returns the name of the *testing.T or testing.TB
+// parameter of the innermost enclosing function for every
+// WaitForResult call of the file. Calls within a subtest like
+//
+//   t.Run(name, func(st *testing.T) { ... })
+//
+// use the *testing.T of the subtest.
+//
+// Calls in a goroutine get an empty name since the
+// *testing.T must not fail the test from another goroutine.
+// Calls in functions without a *testing.T or testing.TB
+// parameter like helpers get noTestVar since there is no t
+// in scope.
+func testVars(f *ast.File, pkgs []string) map[*ast.CallExpr]string {
+	m := map[*ast.CallExpr]string{}
+	ast.Walk(testVarVisitor{m: m, pkgs: pkgs, t: noTestVar}, f)
+	return m
+}
+
+// noTestVar is the name of the *testing.T of the calls
+// in functions without one.
+const noTestVar = "<none>"
+
+type testVarVisitor struct {
+	m    map[*ast.CallExpr]string
+	pkgs []string
+	t    string
+}
+
+func (v testVarVisitor) Visit(n ast.Node) ast.Visitor {
+	switch x := n.(type) {
+	case *ast.FuncDecl:
+		name := testingT(x.Type)
+		if name == "" {
+			name = noTestVar
+		}
+		return testVarVisitor{m: v.m, pkgs: v.pkgs, t: name}
+	case *ast.FuncLit:
+		if name := testingT(x.Type); name != "" {
+			return testVarVisitor{m: v.m, pkgs: v.pkgs, t: name}
+		}
+	case *ast.GoStmt:
+		return testVarVisitor{m: v.m, pkgs: v.pkgs, t: ""}
+	case *ast.CallExpr:
+		if wfrCall(x, v.pkgs) != nil {
+			v.m[x] = v.t
+		}
+	}
+	return v
+}
+
+// checkHandle returns the testing handle which fails the
+// test in the error check of a WaitForResult call if it is
+// a field like s.t. Otherwise, it returns an empty string.
+//
+//   if err := testutil.WaitForResult(...); err != nil {
+//       s.t.Fatal(err)
+//   }
+//
+func checkHandle(check ast.Stmt) string {
+	h := ""
+	ifn, ok := check.(*ast.IfStmt)
+	if !ok {
+		return h
+	}
+	ast.Inspect(ifn.Body, func(n ast.Node) bool {
+		c, ok := n.(*ast.CallExpr)
+		if !ok || h != "" {
+			return h == ""
+		}
+		sel, ok := c.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		switch sel.Sel.Name {
+		case "Fatal", "Fatalf", "FailNow":
+			if x, ok := sel.X.(*ast.SelectorExpr); ok {
+				h = types.ExprString(x)
+			}
+		}
+		return h == ""
+	})
+	return h
+}
+
+// testExpr creates the expression for the testing
+// handle t which is either a name or a field like s.t.
+func testExpr(pos token.Pos, t string) ast.Expr {
+	names := strings.Split(t, ".")
+	var x ast.Expr = &ast.Ident{NamePos: pos, Name: names[0]}
+	for _, name := range names[1:] {
+		x = &ast.SelectorExpr{X: x, Sel: &ast.Ident{Name: name}}
+	}
+	return x
+}
+
+// testingT returns the name of the *testing.T or
+// testing.TB parameter of the function or an empty
+// string.
+func testingT(ft *ast.FuncType) string {
+	for _, p := range ft.Params.List {
+		typ, name := p.Type, "TB"
+		if star, ok := typ.(*ast.StarExpr); ok {
+			typ, name = star.X, "T"
+		}
+		sel, ok := typ.(*ast.SelectorExpr)
+		if !ok || !isIdent(sel.X, "testing") || sel.Sel.Name != name {
+			continue
+		}
+		for _, id := range p.Names {
+			if id.Name != "_" {
+				return id.Name
+			}
+		}
+	}
+	return ""
+}
+
+// position returns the position in the original file.
+func (w *rewriter) position(pos token.Pos) token.Position {
+	return w.orig.Position(pos)
+}
+
+// errorf records an error at the given position.
+func (w *rewriter) errorf(pos token.Pos, format string, args ...interface{}) {
+	w.errs.Add(w.position(pos), fmt.Sprintf(format, args...))
+}
+
+// logf logs a message about the node at pos to the log
+// of the options if there is one.
+func (w *rewriter) logf(pos token.Pos, format string, args ...interface{}) {
+	if w.opts.Log == nil {
+		return
+	}
+	fmt.Fprintf(w.opts.Log, "%s: %s\n", w.position(pos), fmt.Sprintf(format, args...))
+}
+
+// skip logs that the call in the node n is not converted
+// and reports it to the Skipped func of the options.
+func (w *rewriter) skip(call *ast.CallExpr, n ast.Node, reason string) {
+	w.logf(call.Pos(), "%s call in %T not converted: %s", funcName(call.Fun), n, reason)
+	if w.opts.Skipped != nil {
+		w.opts.Skipped(w.position(call.Pos()), reason)
+	}
+}
+
+// rewrite recursively rewrites the statements
+// which use the testutil.WaitForResult construct
+// and replaces them with a for loop which uses
+// the retry package. It reports whether the node
+// was replaced. Constructs which cannot be converted
+// are recorded as errors.
+//
+// The following forms are supported:
+//
+//   if err := testutil.WaitForResult(fn); err != nil { ... }
+//
+//   if testutil.WaitForResult(fn) != nil { ... }
+//
+//   testutil.WaitForResult(fn)
+//
+//   err := testutil.WaitForResult(fn)
+//   if err != nil { ... }
+//
+//   err := testutil.WaitForResult(fn)
+//   require.NoError(t, err)
+//
+func (w *rewriter) rewrite(c apply.ApplyCursor) bool {
+	var call *ast.CallExpr
+	var check ast.Stmt
+	switch n := c.Node().(type) {
+	case *ast.IfStmt:
+		call, check = wfrIf(n, w.opts.Packages), n
+
+	case *ast.ExprStmt:
+		if p := pollCall(n.X); p != nil && w.opts.matches("pollwaiton") {
+			return w.rewritePoll(c, p)
+		}
+		call = wfrCall(n.X, w.opts.Packages)
+
+	case *ast.AssignStmt:
+		call, check = w.wfrAssign(c, n)
+
+	case *ast.ForStmt:
+		w.unwrapLoop(c, n)
+		return false
+	}
+	if !w.opts.matches("waitforresult") {
+		return false
+	}
+	if call == nil {
+		// the init statement of an if statement is
+		// reported together with the if statement.
+		if x := findWFR(c.Node(), w.opts.Packages); x != nil && c.Name() != "Init" {
+			w.skip(x, c.Node(), "unsupported form")
+		}
+		return false
+	}
+	if w.testVars[call] == "" {
+		if w.opts.Warnings != nil {
+			fmt.Fprintf(w.opts.Warnings, "%s: warning: %s call in a goroutine not converted\n", w.position(call.Pos()), funcName(call.Fun))
+		}
+		w.skip(call, c.Node(), "no *testing.T in the goroutine")
+		return false
+	}
+	// the handle of the check, e.g. s.t, is in scope
+	if w.testVars[call] == noTestVar && checkHandle(check) == "" {
+		if w.opts.Warnings != nil {
+			fmt.Fprintf(w.opts.Warnings, "%s: warning: %s call in a function without a *testing.T not converted\n", w.position(call.Pos()), funcName(call.Fun))
+		}
+		w.skip(call, c.Node(), "no *testing.T in the function")
+		return false
+	}
+	if check != nil && w.opts.ReturnErr != "convert" && returnsValue(check) {
+		if w.opts.Warnings != nil {
+			fmt.Fprintf(w.opts.Warnings, "%s: warning: %s call with an error check which returns the error not converted\n", w.position(call.Pos()), funcName(call.Fun))
+		}
+		w.skip(call, c.Node(), "the error is returned")
+		return false
+	}
+	arg, err := wfrArg(call)
+	if err != nil {
+		// report the position of the argument and not of
+		// the call since the call may span many lines.
+		w.errorf(callbackArg(call).Pos(), "%s", err)
+		return false
+	}
+	w.logf(call.Pos(), "%s call in %T matched with callback %T", funcName(call.Fun), c.Node(), arg)
+	// the rewrite changes the original statement.
+	before := w.source(c.Node())
+	if a, ok := c.Node().(*ast.AssignStmt); ok {
+		// the loop fails the test instead of the check.
+		list := stmtList(c.Parent())
+		i := c.Index() + 1
+		joinLines(w.fset, a.End(), check.End())
+		*list = append((*list)[:i], (*list)[i+1:]...)
+		// the error variable is still used after the check.
+		if id := a.Lhs[0].(*ast.Ident); a.Tok == token.DEFINE && usedAfter(*list, i, id.Name) {
+			c.InsertBefore(&ast.DeclStmt{
+				Decl: &ast.GenDecl{
+					TokPos: a.Pos(),
+					Tok:    token.VAR,
+					Specs:  []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{id}, Type: &ast.Ident{Name: "error"}}},
+				},
+			})
+		}
+	}
+	// the loop of a previous call may have needed a label.
+	w.loops, w.switches, w.label = 0, 0, nil
+	w.t = w.testVars[call]
+	if h := checkHandle(check); h != "" {
+		w.t = h
+	}
+
+	var body *ast.BlockStmt
+	switch x := arg.(type) {
+	case *ast.Ident:
+		if lit := w.inlineFunc(x); lit != nil {
+			body = w.rewriteFunc(lit)
+		} else {
+			body = makeSimpleBody(x, w.t)
+		}
+	case *ast.FuncLit:
+		body = w.rewriteFunc(x)
+	case *ast.SelectorExpr:
+		body = makeSimpleBody(x, w.t)
+	}
+	if body == nil {
+		return false
+	}
+	timed := !isRetries(call) && isTimed(body)
+	if timed {
+		w.addComment(c.Node().Pos(), "// TODO: the check depends on time. Verify the timeout of the retry.Timer.")
+	}
+	// the loop has no place for the message of the call.
+	if msg := wfrMessage(call); msg != "" {
+		w.addComment(c.Node().Pos(), "// "+msg)
+	}
+	w.replaceWithLoop(c, call.Pos(), funcName(call.Fun), w.makeRetryer(call, timed), body, before)
+	return true
+}
+
+// replaceWithLoop replaces the statement of the cursor
+// with a for loop with the retryer and the rewritten body
+// of the callback of the call name at callPos. The setup
+// statements of the body are hoisted before the loop.
+// before is the source of the statement for the trace.
+func (w *rewriter) replaceWithLoop(c apply.ApplyCursor, callPos token.Pos, name string, retryer ast.Expr, body *ast.BlockStmt, before string) {
+	pos := c.Node().Pos()
+	if (!w.opts.NoHoist || w.opts.Defer == "hoist") && c.HasIndex() {
+		stmts := w.hoist(body, *stmtList(c.Parent()), c.Node())
+		for _, s := range stmts {
+			c.InsertBefore(s)
+		}
+		// the hoisted statements take the place of the
+		// original statement and the loop starts after them.
+		if len(stmts) > 0 {
+			joinLines(w.fset, pos, stmts[0].Pos())
+			pos = stmts[len(stmts)-1].End()
+			body.Lbrace = pos
+		}
+	}
+	if w.opts.Defer != "keep" && w.opts.Warnings != nil {
+		w.warnDefers(body)
+	}
+	// the comments of the removed error check would end
+	// up after the closing brace of the loop.
+	if body.Rbrace > c.Node().Pos() {
+		w.dropComments(body.Rbrace, c.Node().End())
+	}
+	joinLines(w.fset, body.Rbrace, c.Node().End())
+	loop := w.makeForRetry(pos, retryer, body)
+	w.nest(loop)
+	var repl ast.Stmt = loop
+	if w.label != nil {
+		repl = &ast.LabeledStmt{Label: w.label, Colon: pos, Stmt: loop}
+	}
+	c.Replace(repl)
+	w.replaced(callPos, name, before, repl)
+	w.logf(callPos, "replaced with 'for r := %s; %s {...}'", types.ExprString(loop.Init.(*ast.AssignStmt).Rhs[0]), types.ExprString(loop.Cond))
+}
+
+// unwrapLoop replaces a for loop without a condition
+// which only waits with the generated loop since it
+// would retry the retry loop.
+//
+//   for {
+//       if err := testutil.WaitForResult(fn); err != nil {
+//           t.Fatal(err)
+//       }
+//       break
+//   }
+//
+// Other for loops without a condition which contain a
+// generated loop are reported.
+func (w *rewriter) unwrapLoop(c apply.ApplyCursor, n *ast.ForStmt) {
+	if n.Init != nil || n.Cond != nil || n.Post != nil {
+		return
+	}
+	list := n.Body.List
+	if len(list) == 2 && isBreak(list[1]) {
+		list = list[:1]
+	}
+	if len(list) == 1 {
+		if loop, ok := w.generated(list[0]); ok {
+			joinLines(w.fset, n.Pos(), loop.Pos())
+			joinLines(w.fset, loop.End(), n.End())
+			loop.For = n.For
+			c.Replace(loop)
+			w.logf(n.Pos(), "removed the enclosing for loop of the retry loop")
+			return
+		}
+	}
+	if w.opts.Warnings == nil {
+		return
+	}
+	for _, s := range n.Body.List {
+		if _, ok := w.generated(s); ok {
+			fmt.Fprintf(w.opts.Warnings, "%s: warning: retry loop in a for loop without condition\n", w.position(s.Pos()))
+		}
+	}
+}
+
+// findWFR returns the first WaitForResult call of the
+// statement outside of its nested blocks and function
+// literals or nil.
+func findWFR(n ast.Node, pkgs []string) *ast.CallExpr {
+	if _, ok := n.(ast.Stmt); !ok {
+		return nil
+	}
+	var call *ast.CallExpr
+	ast.Inspect(n, func(x ast.Node) bool {
+		switch x := x.(type) {
+		case *ast.BlockStmt, *ast.FuncLit:
+			return false
+		case *ast.CallExpr:
+			if wfrCall(x, pkgs) != nil {
+				call = x
+			}
+		}
+		return call == nil
+	})
+	return call
+}
+
+// hoist removes the leading setup statements from the
+// loop body and returns them so that they run only once
+// before the loop instead of on every attempt. Setup
+// statements are calls to t.Helper() and assignments of
+// constant values to variables which are not modified in
+// the loop. Variables declared by the setup statements must
+// not be used in the surrounding statement list other than
+// in the statement self which is being converted to avoid
+// conflicting declarations.
+//
+// With the defer mode hoist defer statements which follow the
+// setup statements are moved before the loop as well so
+// that they run only once. They can only refer to
+// variables declared before them which are hoisted too.
+//
+// t.Helper() -> moved before the loop
+// want := 3 -> moved before the loop
+// defer cleanup() -> moved before the loop in hoist mode
+// got := f() -> kept in the loop
+func (w *rewriter) hoist(body *ast.BlockStmt, outer []ast.Stmt, self ast.Node) []ast.Stmt {
+	var list []ast.Stmt
+	for _, s := range outer {
+		if s != self {
+			list = append(list, s)
+		}
+	}
+	i := 0
+	for ; i < len(body.List); i++ {
+		s := body.List[i]
+		if !w.opts.NoHoist && (isHelperCall(s, w.t) || w.isSetupAssign(s, body, list)) {
+			continue
+		}
+		if _, ok := s.(*ast.DeferStmt); ok && w.opts.Defer == "hoist" {
+			continue
+		}
+		break
+	}
+	stmts := body.List[:i:i]
+	body.List = body.List[i:]
+	return stmts
+}
+
+// warnDefers prints a warning for every defer statement
+// which remains in the loop body since the deferred calls
+// of all attempts run at the end of the test.
+func (w *rewriter) warnDefers(body *ast.BlockStmt) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ForStmt:
+			// converted loops have been checked already
+			_, ok := w.depth[x]
+			return !ok
+		case *ast.DeferStmt:
+			fmt.Fprintf(w.opts.Warnings, "%s: warning: deferred call runs at the end of the test for every attempt\n", w.position(n.Pos()))
+		}
+		return true
+	})
+}
+
+// isHelperCall checks if the statement is 't.Helper()'
+// for the *testing.T t.
+func isHelperCall(s ast.Stmt, t string) bool {
+	x, ok := s.(*ast.ExprStmt)
+	if !ok {
+		return false
+	}
+	c, ok := x.X.(*ast.CallExpr)
+	return ok && len(c.Args) == 0 && types.ExprString(c.Fun) == t+".Helper"
+}
+
+// isSetupAssign checks if the statement is a short variable
+// declaration which can be moved out of the loop body.
+// Assignments to variables of the test stay in the loop
+// since the test may use their value after the loop.
+func (w *rewriter) isSetupAssign(s ast.Stmt, body *ast.BlockStmt, outer []ast.Stmt) bool {
+	a, ok := s.(*ast.AssignStmt)
+	if !ok || a.Tok != token.DEFINE || len(a.Lhs) != len(a.Rhs) {
+		return false
+	}
+	for _, x := range a.Rhs {
+		// the testing handle does not change either
+		if types.ExprString(x) != w.t && !isConst(w.file, x) {
+			return false
+		}
+	}
+	for _, x := range a.Lhs {
+		id, ok := x.(*ast.Ident)
+		if !ok || id.Name == "_" || modifies(body, id.Name, a) {
+			return false
+		}
+		for _, o := range outer {
+			if refersTo(o, id.Name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isConst reports whether the expression has the same value
+// in every attempt. These are literals, true, false and nil,
+// the exported names of the imported packages of f like
+// time.Second and the operations on them. Variables, fields,
+// index expressions and dereferences may be polled and are
+// not constant.
+//
+// want := 3              -> constant
+// d := 2 * time.Second   -> constant
+// leader := srv.isLeader -> not constant
+func isConst(f *ast.File, x ast.Expr) bool {
+	switch x := x.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		return x.Name == "true" || x.Name == "false" || x.Name == "nil"
+	case *ast.ParenExpr:
+		return isConst(f, x.X)
+	case *ast.UnaryExpr:
+		return x.Op != token.ARROW && x.Op != token.AND && isConst(f, x.X)
+	case *ast.BinaryExpr:
+		return isConst(f, x.X) && isConst(f, x.Y)
+	case *ast.SelectorExpr:
+		pkg, ok := x.X.(*ast.Ident)
+		return ok && x.Sel.IsExported() && findImport(f, pkg.Name) != nil
+	case *ast.CompositeLit:
+		for _, e := range x.Elts {
+			if kv, ok := e.(*ast.KeyValueExpr); ok {
+				e = kv.Value
+			}
+			if !isConst(f, e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// modifies reports whether the variable with the given name
+// is assigned, incremented or has its address taken in n
+// other than by the statement skip.
+func modifies(n ast.Node, name string, skip ast.Stmt) bool {
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if n == skip {
+				return true
+			}
+			for _, x := range n.Lhs {
+				found = found || isIdent(x, name)
+			}
+		case *ast.IncDecStmt:
+			found = found || isIdent(n.X, name)
+		case *ast.UnaryExpr:
+			found = found || (n.Op == token.AND && isIdent(n.X, name))
+		}
+		return !found
+	})
+	return found
+}
+
+// refersTo reports whether n contains an identifier
+// with the given name.
+func refersTo(n ast.Node, name string) bool {
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		found = found || isIdent(n, name)
+		return !found
+	})
+	return found
+}
+
+// isIdent checks if the node is an identifier with the given name.
+func isIdent(n ast.Node, name string) bool {
+	id, ok := n.(*ast.Ident)
+	return ok && id.Name == name
+}
+
+// isTimed reports whether the loop body refers to the
+// current time, timers or variables which look like a
+// time budget. Converting such a check from WaitForResult
+// may change its timing and needs to be reviewed.
+func isTimed(body *ast.BlockStmt) bool {
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.SelectorExpr:
+			if pkg, ok := x.X.(*ast.Ident); ok && pkg.Name == "time" {
+				switch x.Sel.Name {
+				case "Now", "Since", "Until", "After", "Tick", "NewTimer", "NewTicker", "Duration":
+					found = true
+				}
+			}
+		case *ast.Ident:
+			name := strings.ToLower(x.Name)
+			found = found || strings.Contains(name, "timeout") || strings.Contains(name, "deadline")
+		}
+		return !found
+	})
+	return found
+}
+
+// addComment adds a line comment in front of the
+// statement at pos to the file.
+func (w *rewriter) addComment(pos token.Pos, text string) {
+	pos--
+	cg := &ast.CommentGroup{List: []*ast.Comment{{Slash: pos, Text: text}}}
+	i := sort.Search(len(w.file.Comments), func(i int) bool {
+		return w.file.Comments[i].Pos() >= pos
+	})
+	w.file.Comments = append(w.file.Comments[:i], append([]*ast.CommentGroup{cg}, w.file.Comments[i:]...)...)
+}
+
+// dropComments removes the comments between from and to
+// from the file.
+func (w *rewriter) dropComments(from, to token.Pos) {
+	var list []*ast.CommentGroup
+	for _, cg := range w.file.Comments {
+		if cg.Pos() < from || cg.End() > to {
+			list = append(list, cg)
+		}
+	}
+	w.file.Comments = list
+}
+
+// nest increases the nesting depth of the generated loops
+// within the new loop and renames their retryer to r2, r3, ...
+// so that they do not shadow the retryer of the outer loop.
+func (w *rewriter) nest(loop *ast.ForStmt) {
+	ast.Inspect(loop.Body, func(n ast.Node) bool {
+		if x, ok := n.(*ast.ForStmt); ok {
+			if d, ok := w.depth[x]; ok {
+				w.depth[x] = d + 1
+				name := "r" + strconv.Itoa(d+2)
+				x.Init.(*ast.AssignStmt).Lhs[0].(*ast.Ident).Name = name
+				x.Cond.(*ast.CallExpr).Fun.(*ast.SelectorExpr).X.(*ast.Ident).Name = name
+			}
+		}
+		return true
+	})
+	w.depth[loop] = 0
+}
+
+// joinLines merges the lines between the two positions into
+// a single line. This prevents the printer from emitting
+// blank lines for code which has been removed by the rewrite.
+func joinLines(fset *token.FileSet, from, to token.Pos) {
+	if !from.IsValid() || !to.IsValid() {
+		return
+	}
+	f := fset.File(from)
+	for n := f.Line(to) - f.Line(from); n > 0; n-- {
+		f.MergeLine(f.Line(from))
+	}
+}
+
+// inlineFunc returns the function literal which is assigned
+// to the local variable if inlining is enabled and the variable
+// is only used for the WaitForResult call. Otherwise, it
+// returns nil.
+//
+//   check := func() (bool, error) { ... }
+//   if err := testutil.WaitForResult(check); err != nil { ... }
+//
+func (w *rewriter) inlineFunc(x *ast.Ident) *ast.FuncLit {
+	if !w.opts.Inline || x.Obj == nil || x.Obj.Kind != ast.Var {
+		return nil
+	}
+	lit := funcLitDecl(x.Obj)
+	if lit == nil || countUses(w.file, x.Obj) != 1 {
+		return nil
+	}
+	return lit
+}
+
+// funcLitDecl returns the function literal which is assigned
+// to the object in a 'name := func() ...' statement or nil.
+func funcLitDecl(obj *ast.Object) *ast.FuncLit {
+	a, ok := obj.Decl.(*ast.AssignStmt)
+	if !ok || a.Tok != token.DEFINE || len(a.Lhs) != len(a.Rhs) {
+		return nil
+	}
+	for i, x := range a.Lhs {
+		if id, ok := x.(*ast.Ident); ok && id.Obj == obj {
+			lit, _ := a.Rhs[i].(*ast.FuncLit)
+			return lit
+		}
+	}
+	return nil
+}
+
+// countUses returns the number of references to the object
+// in the file excluding its declaration.
+func countUses(f *ast.File, obj *ast.Object) int {
+	n := 0
+	ast.Inspect(f, func(x ast.Node) bool {
+		if id, ok := x.(*ast.Ident); ok && id.Obj == obj && id.Pos() != declPos(obj) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// declPos returns the position of the identifier
+// in the declaration of the object.
+func declPos(obj *ast.Object) token.Pos {
+	if a, ok := obj.Decl.(*ast.AssignStmt); ok {
+		for _, x := range a.Lhs {
+			if id, ok := x.(*ast.Ident); ok && id.Obj == obj {
+				return id.Pos()
+			}
+		}
+	}
+	return token.NoPos
+}
+
+// removeUnusedFuncs removes the 'name := func() ...' statements
+// whose variable is no longer referenced since the function
+// literal has been inlined.
+func removeUnusedFuncs(fset *token.FileSet, f *ast.File) {
+	apply.Apply(f, func(c apply.ApplyCursor) bool {
+		a, ok := c.Node().(*ast.AssignStmt)
+		if !ok || !c.HasIndex() || len(a.Lhs) != 1 {
+			return true
+		}
+		id, ok := a.Lhs[0].(*ast.Ident)
+		if ok && id.Obj != nil && funcLitDecl(id.Obj) != nil && countUses(f, id.Obj) == 0 {
+			// merge the lines of the statement with the previous
+			// line to avoid a blank line in its place.
+			if tf := fset.File(a.Pos()); tf.Line(a.Pos()) > 1 {
+				joinLines(fset, tf.LineStart(tf.Line(a.Pos())-1), a.End())
+			}
+			c.Delete()
+		}
+		return true
+	}, nil)
+}
+
+// makeSimpleBody creates the loop body for a callback
+// which is a function name or a method value.
+//
+//   if err := s(); err != nil {
+//       t.Log(err)
+//       continue
+//   }
+//   break
+//
+func makeSimpleBody(s ast.Expr, t string) *ast.BlockStmt {
+	return &ast.BlockStmt{
+		Lbrace: s.Pos(),
+		Rbrace: s.End(),
+		List: []ast.Stmt{
+			&ast.IfStmt{
+				If: s.Pos(),
+				Init: &ast.AssignStmt{
+					Lhs: []ast.Expr{
+						&ast.Ident{Name: "err"},
+					},
+					Tok: token.DEFINE,
+					Rhs: []ast.Expr{
+						&ast.CallExpr{Fun: s},
+					},
+				},
+				Cond: &ast.BinaryExpr{
+					X:  &ast.Ident{Name: "err"},
+					Op: token.NEQ,
+					Y:  &ast.Ident{Name: "nil"},
+				},
+				Body: &ast.BlockStmt{
+					List: []ast.Stmt{
+						&ast.ExprStmt{
+							X: &ast.CallExpr{
+								Fun: &ast.SelectorExpr{
+									X:   testExpr(s.Pos(), t),
+									Sel: &ast.Ident{Name: "Log"},
+								},
+								Args: []ast.Expr{
+									&ast.Ident{Name: "err"},
+								},
+							},
+						},
+						&ast.BranchStmt{Tok: token.CONTINUE},
+					},
+				},
+			},
+			&ast.BranchStmt{Tok: token.BREAK},
+		},
+	}
+}
+
+// wfrIf checks if the node is an if statement of the form
+// 'if err := (test*).WaitForResult(...); err != nil { ... }'
+// or 'if (test*).WaitForResult(...) != nil { ... }' and
+// returns the WaitForResult call. The error variable can
+// have any name. Otherwise, it returns nil.
+func wfrIf(ifn *ast.IfStmt, pkgs []string) *ast.CallExpr {
+	// the else branch would be lost
+	if ifn.Else != nil {
+		return nil
+	}
+
+	// if (test*).WaitForResult(...) != nil ?
+	if ifn.Init == nil {
+		if cond, ok := ifn.Cond.(*ast.BinaryExpr); ok && cond.Op == token.NEQ && isIdent(cond.Y, "nil") {
+			return wfrCall(cond.X, pkgs)
+		}
+		return nil
+	}
+
+	// if a := b ; ... or if a = b ; ... ?
+	if a, ok := ifn.Init.(*ast.AssignStmt); ok && isAssign(a) && len(a.Lhs) == 1 && len(a.Rhs) == 1 {
+
+		// if err := ...; err != nil or if err = ...; err != nil ?
+		if id, ok := a.Lhs[0].(*ast.Ident); ok && isNotNil(ifn.Cond, id.Name) {
+
+			// if err := (test*).WaitForResult(...) ?
+			return wfrCall(a.Rhs[0], pkgs)
+		}
+	}
+	return nil
+}
+
+// wfrAssign checks if the node is an assignment of the
+// form 'err := (test*).WaitForResult(...)' or
+// 'err = (test*).WaitForResult(...)' which is
+// immediately followed by an 'if err != nil { ... }'
+// or a 'require.NoError(t, err)' check and returns the
+// WaitForResult call and the check.
+func (w *rewriter) wfrAssign(c apply.ApplyCursor, a *ast.AssignStmt) (*ast.CallExpr, ast.Stmt) {
+	if !isAssign(a) || len(a.Lhs) != 1 || len(a.Rhs) != 1 || !c.HasIndex() {
+		return nil, nil
+	}
+	id, ok := a.Lhs[0].(*ast.Ident)
+	if !ok {
+		return nil, nil
+	}
+	call := wfrCall(a.Rhs[0], w.opts.Packages)
+	if call == nil {
+		return nil, nil
+	}
+
+	list := stmtList(c.Parent())
+	i := c.Index() + 1
+	if list == nil || i >= len(*list) || !isErrCheck((*list)[i], id.Name) {
+		return nil, nil
+	}
+	return call, (*list)[i]
+}
+
+// usedAfter reports whether one of the statements of the
+// list from index i refers to the name.
+func usedAfter(list []ast.Stmt, i int, name string) bool {
+	for _, s := range list[i:] {
+		if refersTo(s, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// returnsValue reports whether the error check of a
+// WaitForResult call returns a value, e.g. the error
+// of a helper, outside of function literals.
+func returnsValue(check ast.Stmt) bool {
+	found := false
+	ast.Inspect(check, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			found = found || len(x.Results) > 0
+		}
+		return !found
+	})
+	return found
+}
+
+// isAssign checks if the statement is either a
+// definition (:=) or a plain assignment (=).
+func isAssign(a *ast.AssignStmt) bool {
+	return a.Tok == token.DEFINE || a.Tok == token.ASSIGN
+}
+
+// stmtList returns a pointer to the statement list
+// of the node or nil if the node has none.
+func stmtList(n ast.Node) *[]ast.Stmt {
+	switch x := n.(type) {
+	case *ast.BlockStmt:
+		return &x.List
+	case *ast.CaseClause:
+		return &x.Body
+	case *ast.CommClause:
+		return &x.Body
+	}
+	return nil
+}
+
+// isErrCheck checks if the statement is an if statement
+// of the form 'if name != nil { ... }' or a call of the
+// form 'require.NoError(t, name)'.
+func isErrCheck(s ast.Stmt, name string) bool {
+	if x, ok := s.(*ast.ExprStmt); ok {
+		return isRequireNoError(x.X, name)
+	}
+	ifn, ok := s.(*ast.IfStmt)
+	return ok && ifn.Init == nil && ifn.Else == nil && isNotNil(ifn.Cond, name)
+}
+
+// isNotNil checks if the expression is 'name != nil'.
+func isNotNil(x ast.Expr, name string) bool {
+	cond, ok := x.(*ast.BinaryExpr)
+	return ok && cond.Op == token.NEQ && isIdent(cond.X, name) && isIdent(cond.Y, "nil")
+}
+
+// isRequireNoError checks if the expression is
+// a call of the form 'require.NoError(t, name)'.
+func isRequireNoError(x ast.Expr, name string) bool {
+	c, ok := x.(*ast.CallExpr)
+	if !ok || len(c.Args) != 2 {
+		return false
+	}
+	f, ok := c.Fun.(*ast.SelectorExpr)
+	if !ok || f.Sel.Name != "NoError" {
+		return false
+	}
+	if pkg, ok := f.X.(*ast.Ident); !ok || pkg.Name != "require" {
+		return false
+	}
+	arg, ok := c.Args[1].(*ast.Ident)
+	return ok && arg.Name == name
+}
+
+// wfrCall returns the call expression if the expression
+// is a call of the form (test*).WaitForResult(arg),
+// (test*).WaitForResult(arg, "message") or
+// (test*).WaitForResultRetries(n, arg). The package
+// qualifier is optional to support dot-imports unless
+// pkgs is not empty. Then it must be one of pkgs.
+// Otherwise, it returns nil.
+func wfrCall(x ast.Expr, pkgs []string) *ast.CallExpr {
+	c, ok := x.(*ast.CallExpr)
+	if !ok || !inPkgs(c.Fun, pkgs) {
+		return nil
+	}
+	switch name := funcName(c.Fun); {
+	case name == "WaitForResult" && len(c.Args) == 1:
+		return c
+	case name == "WaitForResult" && len(c.Args) == 2 && wfrMessage(c) != "":
+		return c
+	case name == "WaitForResultRetries" && len(c.Args) == 2:
+		return c
+	}
+	return nil
+}
+
+// inPkgs reports whether the function is qualified
+// with one of the package names. All functions match
+// if pkgs is empty.
+func inPkgs(fun ast.Expr, pkgs []string) bool {
+	if len(pkgs) == 0 {
+		return true
+	}
+	sel, ok := fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	for _, p := range pkgs {
+		if isIdent(sel.X, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// funcName returns the name of the called function
+// for 'fn(...)' and 'x.fn(...)' calls.
+func funcName(fun ast.Expr) string {
+	switch f := fun.(type) {
+	case *ast.Ident:
+		return f.Name
+	case *ast.SelectorExpr:
+		return f.Sel.Name
+	}
+	return ""
+}
+
+// wfrMessage returns the message of a
+// (test*).WaitForResult(fn, "message") call
+// or an empty string.
+func wfrMessage(c *ast.CallExpr) string {
+	if len(c.Args) != 2 || isRetries(c) {
+		return ""
+	}
+	lit, ok := c.Args[1].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return ""
+	}
+	msg, err := strconv.Unquote(lit.Value)
+	if err != nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(msg), " ")
+}
+
+// callbackArg returns the callback argument
+// of the WaitForResult call.
+func callbackArg(c *ast.CallExpr) ast.Expr {
+	if isRetries(c) {
+		return c.Args[1]
+	}
+	return c.Args[0]
+}
+
+// isRetries checks if the call is a
+// (test*).WaitForResultRetries call.
+func isRetries(c *ast.CallExpr) bool {
+	return funcName(c.Fun) == "WaitForResultRetries"
+}
+
+// wfrArg returns the callback function literal, the
+// name of the test function or the method value of the
+// WaitForResult call. It returns an error if the callback is of an
+// unsupported type.
+func wfrArg(c *ast.CallExpr) (ast.Node, error) {
+	switch arg0 := callbackArg(c).(type) {
+	// (test*).WaitForResult(someFunc)
+	case *ast.Ident:
+		if !isFuncName(arg0) {
+			return nil, fmt.Errorf("invalid WaitForResult arg %s: not a function", arg0.Name)
+		}
+		return arg0, nil
+
+	// (test*).WaitForResult(func() (bool, error) {...})
+	case *ast.FuncLit:
+		return arg0, nil
+
+	// (test*).WaitForResult(srv.checkReady)
+	case *ast.SelectorExpr:
+		return arg0, nil
+
+	default:
+		return nil, fmt.Errorf("invalid WaitForResult arg type: %T", arg0)
+	}
+}
+
+// isFuncName reports whether the identifier can name a
+// function. Names of other files of the package are not
+// resolved and are assumed to be functions. Constants,
+// types and the predeclared names like nil are not.
+func isFuncName(x *ast.Ident) bool {
+	if x.Obj == nil {
+		return types.Universe.Lookup(x.Name) == nil
+	}
+	return x.Obj.Kind == ast.Fun || x.Obj.Kind == ast.Var
+}
+
+// makeForRetry creates a for loop with a retryer
+// which replaces the if stmt with testutil.WaitForResult.
+// It expects a body that is rewritten for the for loop.
+// The loop is placed at pos so that comments before
+// the original statement stay in front of it. The
+// *testing.T of the call fails the test.
+//
+//   v1: r.NextOr(t.FailNow)
+//   v2: r.NextOr(t, t.FailNow)
+//
+// The retryer is called rr or retryR if r is used by the
+// body or is the name of the *testing.T since the loop
+// variable would shadow it.
+func (w *rewriter) makeForRetry(pos token.Pos, retryer ast.Expr, body *ast.BlockStmt) *ast.ForStmt {
+	r := "r"
+	for _, name := range []string{"r", "rr", "retryR"} {
+		if r = name; !w.usesName(body, name) && strings.Split(w.t, ".")[0] != name {
+			break
+		}
+	}
+	args := []ast.Expr{
+		&ast.SelectorExpr{
+			X:   testExpr(token.NoPos, w.t),
+			Sel: &ast.Ident{Name: "FailNow"},
+		},
+	}
+	if w.opts.RetryAPI == "v2" {
+		args = append([]ast.Expr{testExpr(token.NoPos, w.t)}, args...)
+	}
+	return &ast.ForStmt{
+		For: pos,
+		Init: &ast.AssignStmt{
+			Lhs: []ast.Expr{
+				&ast.Ident{Name: r},
+			},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{
+				retryer,
+			},
+		},
+		Cond: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   &ast.Ident{Name: r},
+				Sel: &ast.Ident{Name: "NextOr"},
+			},
+			Args: args,
+		},
+		Body: body,
+	}
+}
+
+// usesName reports whether the body refers to the name
+// outside of the retryers of the generated loops which are
+// renamed by nest.
+func (w *rewriter) usesName(body *ast.BlockStmt, name string) bool {
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		if x, ok := n.(*ast.ForStmt); ok {
+			if _, ok := w.depth[x]; ok {
+				found = found || w.usesName(x.Body, name)
+				return false
+			}
+		}
+		found = found || isIdent(n, name)
+		return !found
+	})
+	return found
+}
+
+// makeRetryer creates the expression for the retryer of
+// the for loop. This is retry.OneSec() unless a timeout
+// has been set or the callback is timing sensitive in
+// which case a retry.Timer is created. The timeout of
+// the timer defaults to one second.
+// WaitForResultRetries(n, ...) calls use a retry.Counter
+// with n attempts.
+func (w *rewriter) makeRetryer(c *ast.CallExpr, timed bool) ast.Expr {
+	if isRetries(c) {
+		return w.makeRetryLit("Counter",
+			&ast.KeyValueExpr{Key: &ast.Ident{Name: "Count"}, Value: c.Args[0]},
+			&ast.KeyValueExpr{Key: &ast.Ident{Name: "Wait"}, Value: makeDuration(w.opts.Wait)},
+		)
+	}
+	if w.opts.Attempts > 0 {
+		return w.makeRetryLit("Counter",
+			&ast.KeyValueExpr{Key: &ast.Ident{Name: "Count"}, Value: &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(w.opts.Attempts)}},
+			&ast.KeyValueExpr{Key: &ast.Ident{Name: "Wait"}, Value: makeDuration(w.opts.Wait)},
+		)
+	}
+	if w.opts.Timeout <= 0 && !timed {
+		return &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   &ast.Ident{Name: w.opts.retryName()},
+				Sel: &ast.Ident{Name: "OneSec"},
+			},
+		}
+	}
+
+	d := w.opts.Timeout
+	if d <= 0 {
+		d = time.Second
+	}
+	return w.makeRetryLit("Timer",
+		&ast.KeyValueExpr{Key: &ast.Ident{Name: "Timeout"}, Value: makeDuration(d)},
+		&ast.KeyValueExpr{Key: &ast.Ident{Name: "Wait"}, Value: makeDuration(w.opts.Wait)},
+	)
+}
+
+// makeRetryLit creates the expression '(&retry.<typ>{elts})'.
+// The composite literal needs to be in parens since it is
+// part of the for statement header.
+func (w *rewriter) makeRetryLit(typ string, elts ...ast.Expr) ast.Expr {
+	return &ast.ParenExpr{
+		X: &ast.UnaryExpr{
+			Op: token.AND,
+			X: &ast.CompositeLit{
+				Type: &ast.SelectorExpr{
+					X:   &ast.Ident{Name: w.opts.retryName()},
+					Sel: &ast.Ident{Name: typ},
+				},
+				Elts: elts,
+			},
+		},
+	}
+}
+
+// makeDuration creates an expression for the duration
+// using the largest unit which represents it exactly,
+// e.g. 1500ms becomes 1500 * time.Millisecond.
+func makeDuration(d time.Duration) ast.Expr {
+	if d == 0 {
+		return &ast.BasicLit{Kind: token.INT, Value: "0"}
+	}
+	units := []struct {
+		d    time.Duration
+		name string
+	}{
+		{time.Hour, "Hour"},
+		{time.Minute, "Minute"},
+		{time.Second, "Second"},
+		{time.Millisecond, "Millisecond"},
+		{time.Microsecond, "Microsecond"},
+		{time.Nanosecond, "Nanosecond"},
+	}
+	for _, u := range units {
+		if d%u.d != 0 {
+			continue
+		}
+		x := &ast.SelectorExpr{
+			X:   &ast.Ident{Name: "time"},
+			Sel: &ast.Ident{Name: u.name},
+		}
+		if d == u.d {
+			return x
+		}
+		return &ast.BinaryExpr{
+			X:  &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(int64(d/u.d), 10)},
+			Op: token.MUL,
+			Y:  x,
+		}
+	}
+	panic("unreachable")
+}
+
+// rewriteFunc transforms the body of the callback.
+func (w *rewriter) rewriteFunc(lit *ast.FuncLit) *ast.BlockStmt {
+	w.results = lit.Type.Results.NumFields()
+	w.boolResult = w.results == 1 && isIdent(lit.Type.Results.List[0].Type, "bool")
+	w.named = nil
+	var decls []ast.Stmt
+	if lit.Type.Results != nil {
+		for _, f := range lit.Type.Results.List {
+			if len(f.Names) == 0 {
+				continue
+			}
+			w.named = append(w.named, f.Names...)
+			// named results become local variables of the loop body
+			decls = append(decls, &ast.DeclStmt{
+				Decl: &ast.GenDecl{
+					TokPos: lit.Body.Lbrace,
+					Tok:    token.VAR,
+					Specs:  []ast.Spec{&ast.ValueSpec{Names: f.Names, Type: f.Type}},
+				},
+			})
+		}
+	}
+	// the context of the callback becomes a local variable
+	// of the loop body and is dropped if it is not used.
+	if ctx, pkg := contextParam(lit.Type); ctx != nil && refersTo(lit.Body, ctx.Name) {
+		decls = append(decls, &ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.Ident{NamePos: lit.Body.Lbrace, Name: ctx.Name}},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{
+				&ast.CallExpr{
+					Fun: &ast.SelectorExpr{
+						X:   &ast.Ident{NamePos: lit.Body.Lbrace, Name: pkg},
+						Sel: &ast.Ident{Name: "Background"},
+					},
+				},
+			},
+		})
+	}
+	body := w.rewriteBody(lit.Body)
+	if body != nil {
+		body.List = append(decls, body.List...)
+	}
+	return body
+}
+
+// contextParam returns the name of the context.Context
+// parameter of a func(ctx context.Context) (bool, error)
+// callback and the name of the context package or nil.
+func contextParam(ft *ast.FuncType) (*ast.Ident, string) {
+	if ft.Params.NumFields() != 1 || len(ft.Params.List[0].Names) != 1 {
+		return nil, ""
+	}
+	p := ft.Params.List[0]
+	sel, ok := p.Type.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Context" {
+		return nil, ""
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	if !ok || p.Names[0].Name == "_" {
+		return nil, ""
+	}
+	return p.Names[0], pkg.Name
+}
+
+// rewriteBody transforms the body of the
+// WaitForResult(func() (bool, error) {...})
+// callback.
+func (w *rewriter) rewriteBody(n ast.Node) *ast.BlockStmt {
+	body, ok := n.(*ast.BlockStmt)
+	if !ok {
+		w.errorf(n.Pos(), "callback body is %T instead of *ast.BlockStmt", n)
+		return nil
+	}
+	list := w.rewriteStmts(body.List, true)
+
+	// a callback which does not end with a return has no
+	// success path and the attempt succeeds after its last
+	// statement unless it ends the test.
+	if n := len(body.List); n == 0 || w.fallsThrough(body.List[n-1]) {
+		list = append(list, &ast.BranchStmt{TokPos: body.Rbrace, Tok: token.BREAK})
+		w.logf(body.Rbrace, "callback does not return. Added a break after the last statement")
+	}
+	return &ast.BlockStmt{
+		Lbrace: body.Lbrace,
+		List:   list,
+		Rbrace: body.Rbrace,
+	}
+}
+
+// fallsThrough reports whether the last statement of a
+// callback is an expression statement which does not end
+// the test like panic, t.Fatal or t.Skip.
+func (w *rewriter) fallsThrough(s ast.Stmt) bool {
+	x, ok := s.(*ast.ExprStmt)
+	if !ok {
+		return false
+	}
+	c, ok := x.X.(*ast.CallExpr)
+	if !ok {
+		return true
+	}
+	switch types.ExprString(c.Fun) {
+	case "panic", w.t + ".Fatal", w.t + ".Fatalf", w.t + ".FailNow", w.t + ".Skip", w.t + ".Skipf", w.t + ".SkipNow":
+		return false
+	}
+	return true
+}
+
+// rewriteStmts rewrites the return statements and the
+// NoError assertions in the list and in the branches of
+// its if statements and blocks. If the list is not the
+// loop body itself the attempt has to be ended explicitly
+// after a conditional break.
+func (w *rewriter) rewriteStmts(list []ast.Stmt, loopBody bool) []ast.Stmt {
+	var out []ast.Stmt
+	for _, x := range list {
+		switch s := x.(type) {
+		case *ast.IfStmt:
+			w.rewriteIf(s)
+
+		case *ast.BlockStmt:
+			s.List = w.rewriteStmts(s.List, false)
+
+		case *ast.ForStmt:
+			w.loops++
+			s.Body.List = w.rewriteStmts(s.Body.List, false)
+			w.loops--
+
+		case *ast.RangeStmt:
+			w.loops++
+			s.Body.List = w.rewriteStmts(s.Body.List, false)
+			w.loops--
+
+		case *ast.SwitchStmt:
+			w.rewriteClauses(s.Body)
+
+		case *ast.TypeSwitchStmt:
+			w.rewriteClauses(s.Body)
+
+		case *ast.SelectStmt:
+			w.rewriteClauses(s.Body)
+
+		case *ast.LabeledStmt:
+			// a labeled return becomes a labeled block
+			if stmts := w.rewriteStmts([]ast.Stmt{s.Stmt}, loopBody); len(stmts) == 1 {
+				s.Stmt = stmts[0]
+			} else {
+				s.Stmt = &ast.BlockStmt{Lbrace: s.Stmt.Pos(), List: stmts, Rbrace: s.Stmt.End()}
+			}
+
+		case *ast.ExprStmt:
+			if x := noErrorArg(s, w.t, w.opts.AssertPkgs); x != nil && !w.opts.NoReceiverSwap {
+				stmts := []ast.Stmt{w.errCheck(s.Pos(), x)}
+				w.labelBranches(stmts)
+				out = append(out, stmts...)
+				continue
+			}
+
+		case *ast.ReturnStmt:
+			var stmts []ast.Stmt
+			if w.poll {
+				stmts = w.rewritePollReturn(s)
+			} else {
+				stmts = w.rewriteReturn(s)
+			}
+			last := stmts[len(stmts)-1]
+			if _, ok := last.(*ast.BranchStmt); !ok && !loopBody && !w.isFatal(last) {
+				stmts = append(stmts, &ast.BranchStmt{TokPos: s.Pos(), Tok: token.CONTINUE})
+			}
+			w.labelBranches(stmts)
+			out = append(out, stmts...)
+			continue
+		}
+		out = append(out, x)
+	}
+	return out
+}
+
+// rewriteClauses rewrites the return statements in the
+// case clauses of a switch or select statement.
+func (w *rewriter) rewriteClauses(body *ast.BlockStmt) {
+	w.switches++
+	for _, x := range body.List {
+		switch cc := x.(type) {
+		case *ast.CaseClause:
+			cc.Body = w.rewriteStmts(cc.Body, false)
+		case *ast.CommClause:
+			cc.Body = w.rewriteStmts(cc.Body, false)
+		}
+	}
+	w.switches--
+}
+
+// labelBranches adds the label of the loop to the break
+// and continue statements of a rewritten return statement
+// which would otherwise end a for, switch or select
+// statement of the callback instead of the attempt.
+//
+//   for _, s := range servers {
+//       if !s.Ready() {
+//           continue retry
+//       }
+//   }
+//
+func (w *rewriter) labelBranches(stmts []ast.Stmt) {
+	for _, s := range stmts {
+		ast.Inspect(s, func(n ast.Node) bool {
+			switch x := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.BranchStmt:
+				if x.Label == nil && (w.loops > 0 || w.switches > 0 && x.Tok == token.BREAK) {
+					x.Label = &ast.Ident{NamePos: x.TokPos, Name: w.loopLabel().Name}
+				}
+			}
+			return true
+		})
+	}
+}
+
+// loopLabel returns the label of the loop which
+// is currently generated. The label is unique
+// within the file.
+func (w *rewriter) loopLabel() *ast.Ident {
+	if w.label == nil {
+		name := "retry"
+		for i := 2; w.labels[name]; i++ {
+			name = "retry" + strconv.Itoa(i)
+		}
+		w.labels[name] = true
+		w.label = &ast.Ident{Name: name}
+	}
+	return w.label
+}
+
+// rewrite return statements
+//
+// return true, val -> break
+// return false, nil -> continue
+// return false, val -> t.Log(val); continue
+// return false, fmt.Errorf(f, args...) -> t.Logf(f, args...); continue
+// return false, errors.New(msg) -> t.Log(msg); continue
+// return false, errors.Wrap(err, msg) -> t.Log(errors.Wrap(err, msg)); continue
+// return expr, val -> if expr { break } t.Log(val)
+// return ok, val -> if ok { break } t.Log(val)
+// return err == nil, nil -> if err != nil { t.Log(err); continue } break
+// return -> continue
+// return -> return ok, err for named results
+// return err -> if err != nil { t.Log(err); continue } break
+// return f() -> if ok, err := f(); !ok { t.Log(err); continue } break
+// return ok -> return ok, "condition not met" for func() bool
+func (w *rewriter) rewriteReturn(s *ast.ReturnStmt) (stmts []ast.Stmt) {
+	// ast.Print(token.NewFileSet(), s.Results)
+	switch len(s.Results) {
+	case 0:
+		if len(w.named) == 1 && w.boolResult {
+			return w.rewriteReturn(&ast.ReturnStmt{
+				Return:  s.Return,
+				Results: []ast.Expr{&ast.Ident{NamePos: s.Pos(), Name: w.named[0].Name}},
+			})
+		}
+		if len(w.named) == 2 {
+			return w.rewriteReturn(&ast.ReturnStmt{
+				Return: s.Return,
+				Results: []ast.Expr{
+					&ast.Ident{NamePos: s.Pos(), Name: w.named[0].Name},
+					&ast.Ident{NamePos: s.Pos(), Name: w.named[1].Name},
+				},
+			})
+		}
+		return []ast.Stmt{&ast.BranchStmt{TokPos: s.Pos(), Tok: token.CONTINUE}}
+	case 1:
+		if w.boolResult {
+			return w.rewriteReturn(&ast.ReturnStmt{
+				Return:  s.Return,
+				Results: []ast.Expr{s.Results[0], w.boolMessage(s.Pos())},
+			})
+		}
+		if c, ok := s.Results[0].(*ast.CallExpr); ok && w.results == 2 {
+			return rewriteCallReturn(s.Pos(), c, w.t)
+		}
+		return w.rewriteErrReturn(s)
+	}
+
+	// log the error of a nil check instead of nothing
+	if x := isNilOf(s.Results[0]); x != nil && isIdent(s.Results[1], "nil") {
+		return w.rewriteErrReturn(&ast.ReturnStmt{Return: s.Return, Results: []ast.Expr{x}})
+	}
+
+	var cont bool
+	switch x := unparen(s.Results[0]).(type) {
+	case *ast.Ident:
+		switch x.Name {
+		case "true":
+			// the error of a success is dropped.
+			if !isIdent(s.Results[1], "nil") && w.opts.Warnings != nil {
+				fmt.Fprintf(w.opts.Warnings, "%s: warning: success returned with the error %s which is dropped\n", w.position(s.Pos()), types.ExprString(s.Results[1]))
+			}
+			return []ast.Stmt{&ast.BranchStmt{TokPos: s.Pos(), Tok: token.BREAK}}
+		case "false":
+			cont = true
+		default:
+			stmts = breakIf(s.Pos(), x)
+		}
+
+	case *ast.BinaryExpr, *ast.CallExpr, *ast.UnaryExpr, *ast.SelectorExpr, *ast.IndexExpr:
+		stmts = breakIf(s.Pos(), x)
+
+	default:
+		w.errorf(s.Results[0].Pos(), "unsupported result type %T", s.Results[0])
+		return []ast.Stmt{s}
+	}
+
+	var args []ast.Expr
+	format := false
+	switch x := s.Results[1].(type) {
+	case *ast.Ident:
+		if x.Name != "nil" {
+			args = []ast.Expr{x}
+		} else if w.opts.NilMessage != "" {
+			args = []ast.Expr{makeNilMessage(s.Pos(), w.opts.NilMessage)}
+		}
+
+	case *ast.CallExpr:
+		if fname, fatalf := callName(x), types.ExprString(x.Fun) == w.t+".Fatalf"; fatalf || w.isErrorf(fname) {
+			args = x.Args
+			if !fatalf {
+				args = unwrapFormat(args)
+			}
+			format = hasVerb(args)
+		} else if fname == "errors.New" && len(x.Args) == 1 {
+			args = x.Args
+		} else {
+			args = []ast.Expr{x}
+		}
+
+	default:
+		args = []ast.Expr{x}
+	}
+
+	if len(args) > 0 {
+		logf := "Logf"
+		if len(args) == 1 && !format {
+			logf = "Log"
+		}
+		stmts = append(stmts, &ast.ExprStmt{
+			X: &ast.CallExpr{
+				Fun: &ast.SelectorExpr{
+					X:   testExpr(s.Pos(), w.t),
+					Sel: &ast.Ident{Name: logf},
+				},
+				Args: args,
+			},
+		})
+	}
+	if cont {
+		stmts = append(stmts, &ast.BranchStmt{TokPos: s.Pos(), Tok: token.CONTINUE})
+	}
+	return
+}
+
+// breakIf creates the statement 'if cond { break }'.
+// The retry condition is used as is since the loop
+// breaks when it holds. No negation is required.
+func breakIf(pos token.Pos, cond ast.Expr) []ast.Stmt {
+	return []ast.Stmt{
+		&ast.IfStmt{
+			If:   pos,
+			Cond: cond,
+			Body: &ast.BlockStmt{
+				List: []ast.Stmt{
+					&ast.BranchStmt{TokPos: pos, Tok: token.BREAK},
+				},
+			},
+		},
+	}
+}
+
+// rewriteCallReturn rewrites a return statement of a
+// (bool, error) callback which returns the results of a
+// call to another (bool, error) function.
+//
+// return f() -> if ok, err := f(); !ok { t.Log(err); continue } break
+func rewriteCallReturn(pos token.Pos, c *ast.CallExpr, t string) []ast.Stmt {
+	ifn := &ast.IfStmt{
+		If: pos,
+		Init: &ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.Ident{NamePos: pos, Name: "ok"}, &ast.Ident{NamePos: pos, Name: "err"}},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{c},
+		},
+		Cond: &ast.UnaryExpr{OpPos: pos, Op: token.NOT, X: &ast.Ident{NamePos: pos, Name: "ok"}},
+		Body: &ast.BlockStmt{
+			List: []ast.Stmt{
+				&ast.ExprStmt{
+					X: &ast.CallExpr{
+						Fun: &ast.SelectorExpr{
+							X:   testExpr(pos, t),
+							Sel: &ast.Ident{Name: "Log"},
+						},
+						Args: []ast.Expr{&ast.Ident{NamePos: pos, Name: "err"}},
+					},
+				},
+				&ast.BranchStmt{TokPos: pos, Tok: token.CONTINUE},
+			},
+		},
+	}
+	return []ast.Stmt{ifn, &ast.BranchStmt{TokPos: pos, Tok: token.BREAK}}
+}
+
+// rewriteErrReturn rewrites a return statement with a single
+// error value into an error check. Call expressions are
+// assigned to a local err variable first.
+//
+// return err -> if err != nil { t.Log(err); continue } break
+// return f() -> if err := f(); err != nil { t.Log(err); continue } break
+func (w *rewriter) rewriteErrReturn(s *ast.ReturnStmt) []ast.Stmt {
+	return []ast.Stmt{w.errCheck(s.Pos(), s.Results[0]), &ast.BranchStmt{TokPos: s.Pos(), Tok: token.BREAK}}
+}
+
+// errCheck creates the statement which ends the attempt
+// if the error is not nil.
+//
+// err -> if err != nil { t.Log(err); continue }
+// f() -> if err := f(); err != nil { t.Log(err); continue }
+func (w *rewriter) errCheck(pos token.Pos, x ast.Expr) *ast.IfStmt {
+	ifn := &ast.IfStmt{If: pos}
+	verr, ok := x.(*ast.Ident)
+	if !ok {
+		verr = &ast.Ident{NamePos: pos, Name: "err"}
+		ifn.Init = &ast.AssignStmt{
+			Lhs: []ast.Expr{verr},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{x},
+		}
+	}
+	ifn.Cond = &ast.BinaryExpr{
+		X:  &ast.Ident{NamePos: pos, Name: verr.Name},
+		Op: token.NEQ,
+		Y:  &ast.Ident{NamePos: pos, Name: "nil"},
+	}
+	ifn.Body = &ast.BlockStmt{
+		List: []ast.Stmt{
+			&ast.ExprStmt{
+				X: &ast.CallExpr{
+					Fun: &ast.SelectorExpr{
+						X:   testExpr(pos, w.t),
+						Sel: &ast.Ident{Name: "Log"},
+					},
+					Args: []ast.Expr{&ast.Ident{NamePos: pos, Name: verr.Name}},
+				},
+			},
+			&ast.BranchStmt{TokPos: pos, Tok: token.CONTINUE},
+		},
+	}
+	return ifn
+}
+
+// rewrite if statements in the callback
+//
+// if cond { return false, fmt.Errorf(f, a) } -> if cond { t.Logf(f, a); continue }
+// if cond { return false, fmt.Errorf(f) } -> if cond { t.Log(f); continue }
+// if cond { return false, val } -> if cond { t.Log(val); continue }
+// if cond { return false, nil } -> if cond { continue }
+// if cond { return true, nil } else { ... } -> if cond { break } else { ... }
+// if cond { return expr, val } -> if cond { if expr { break } t.Log(val); continue }
+func (w *rewriter) rewriteIf(s *ast.IfStmt) {
+	s.Body.List = w.rewriteStmts(s.Body.List, false)
+	switch x := s.Else.(type) {
+	case *ast.IfStmt:
+		w.rewriteIf(x)
+	case *ast.BlockStmt:
+		x.List = w.rewriteStmts(x.List, false)
+	}
+}
+
+// callName returns the name of the called function
+// as 'pkg.Func' or 'Func' or the empty string for other
+// call expressions.
+func callName(c *ast.CallExpr) string {
+	switch f := c.Fun.(type) {
+	case *ast.Ident:
+		return f.Name
+	case *ast.SelectorExpr:
+		if x, ok := f.X.(*ast.Ident); ok {
+			return x.Name + "." + f.Sel.Name
+		}
+	}
+	return ""
+}
+
+// isNilOf returns the operand of the comparison
+// 'x == nil' or 'nil == x' or nil.
+func isNilOf(x ast.Expr) ast.Expr {
+	b, ok := unparen(x).(*ast.BinaryExpr)
+	if !ok || b.Op != token.EQL {
+		return nil
+	}
+	switch {
+	case isIdent(b.Y, "nil") && !isIdent(b.X, "nil"):
+		return unparen(b.X)
+	case isIdent(b.X, "nil") && !isIdent(b.Y, "nil"):
+		return unparen(b.Y)
+	}
+	return nil
+}
+
+// unparen returns the expression without enclosing parentheses.
+func unparen(x ast.Expr) ast.Expr {
+	for {
+		p, ok := x.(*ast.ParenExpr)
+		if !ok {
+			return x
+		}
+		x = p.X
+	}
+}
+
+// unwrapFormat returns the arguments of a fmt.Errorf call
+// with the %w verbs of the format replaced by %v since
+// t.Logf does not wrap errors. The error message stays
+// the same. Wrapped errors of other calls like errors.Wrap
+// are logged as they are for the same reason.
+func unwrapFormat(args []ast.Expr) []ast.Expr {
+	if len(args) == 0 {
+		return args
+	}
+	lit, ok := args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING || !strings.Contains(lit.Value, "%w") {
+		return args
+	}
+	v := []byte(lit.Value)
+	for i := 0; i < len(v)-1; i++ {
+		if v[i] != '%' {
+			continue
+		}
+		i++
+		if v[i] == 'w' {
+			v[i] = 'v'
+		}
+	}
+	unwrapped := *lit
+	unwrapped.Value = string(v)
+	return append([]ast.Expr{&unwrapped}, args[1:]...)
+}
+
+// isErrorf reports whether the function is fmt.Errorf or
+// one of the printf-style error constructors of the options.
+func (w *rewriter) isErrorf(fname string) bool {
+	if fname == "fmt.Errorf" {
+		return true
+	}
+	for _, f := range w.opts.ErrorfFuncs {
+		if fname == f {
+			return true
+		}
+	}
+	return false
+}
+
+// hasVerb reports whether the format of the arguments of
+// a formatting call is a string literal with a % since
+// t.Log would print "%s" or "100%%" as is.
+func hasVerb(args []ast.Expr) bool {
+	if len(args) == 0 {
+		return false
+	}
+	lit, ok := args[0].(*ast.BasicLit)
+	return ok && lit.Kind == token.STRING && strings.Contains(lit.Value, "%")
+}
+
+// boolMessage returns the message for a callback which
+// returns only false. This is nil if the message is empty
+// which makes it a 'return false, nil'.
+func (w *rewriter) boolMessage(pos token.Pos) ast.Expr {
+	if w.opts.BoolMessage == "" {
+		return &ast.Ident{NamePos: pos, Name: "nil"}
+	}
+	return makeNilMessage(pos, w.opts.BoolMessage)
+}
+
+// makeNilMessage creates the string literal of the
+// message which is logged instead of a nil error.
+func makeNilMessage(pos token.Pos, msg string) *ast.BasicLit {
+	return &ast.BasicLit{ValuePos: pos, Kind: token.STRING, Value: strconv.Quote(msg)}
+}
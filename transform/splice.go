@@ -0,0 +1,93 @@
+package transform
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/printer"
+	"go/token"
+	"io"
+)
+
+// printDecls returns the formatted source of the top-level
+// declarations of the file including their comments.
+func printDecls(fset *token.FileSet, f *ast.File, cfg *printer.Config) ([]string, error) {
+	var decls []string
+	for _, d := range f.Decls {
+		var b bytes.Buffer
+		if err := printNode(&b, fset, &printer.CommentedNode{Node: d, Comments: f.Comments}, cfg); err != nil {
+			return nil, err
+		}
+		decls = append(decls, b.String())
+	}
+	return decls, nil
+}
+
+// spliceDecls returns the source of the transformed file
+// where only the top-level declarations which differ from
+// the original ones are replaced by their formatted source.
+// The remaining code is copied verbatim from src so that
+// the formatting of untouched code is preserved.
+//
+// orig are the declarations of the file before the
+// transformation as returned by printDecls. If
+// declarations have been added or removed, e.g. an import
+// declaration, the whole file is formatted instead.
+func spliceDecls(fset *token.FileSet, f *ast.File, src []byte, orig []string, cfg *printer.Config) ([]byte, error) {
+	ast.SortImports(fset, f)
+	decls, err := printDecls(fset, f, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(decls) != len(orig) {
+		return formatFile(fset, f, cfg)
+	}
+
+	var b bytes.Buffer
+	last := 0
+	for i, d := range f.Decls {
+		if decls[i] == orig[i] {
+			continue
+		}
+		start, end := d.Pos(), d.End()
+		if doc := declDoc(d); doc != nil {
+			start = doc.Pos()
+		}
+		from, to := fset.Position(start).Offset, fset.Position(end).Offset
+		b.Write(src[last:from])
+		b.WriteString(decls[i])
+		last = to
+	}
+	b.Write(src[last:])
+	return b.Bytes(), nil
+}
+
+// formatFile returns the formatted source of the whole file.
+func formatFile(fset *token.FileSet, f *ast.File, cfg *printer.Config) ([]byte, error) {
+	ast.SortImports(fset, f)
+	var b bytes.Buffer
+	if err := printNode(&b, fset, f, cfg); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// printNode prints the node with the printer configuration
+// or formats it like gofmt if cfg is nil.
+func printNode(w io.Writer, fset *token.FileSet, node interface{}, cfg *printer.Config) error {
+	if cfg == nil {
+		return format.Node(w, fset, node)
+	}
+	return cfg.Fprint(w, fset, node)
+}
+
+// declDoc returns the doc comment of the declaration or nil.
+func declDoc(d ast.Decl) *ast.CommentGroup {
+	switch x := d.(type) {
+	case *ast.FuncDecl:
+		return x.Doc
+	case *ast.GenDecl:
+		return x.Doc
+	}
+	return nil
+}
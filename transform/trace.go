@@ -0,0 +1,89 @@
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"strings"
+)
+
+// formatNode returns the source of the node. The
+// error is returned as a comment if it cannot be
+// formatted.
+func formatNode(fset *token.FileSet, n ast.Node) string {
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, n); err != nil {
+		return "// " + err.Error()
+	}
+	return buf.String()
+}
+
+// source returns the source of the node for the trace
+// and the Converted callback or an empty string if
+// neither is set.
+func (w *rewriter) source(n ast.Node) string {
+	if w.opts.Trace == nil && w.opts.Converted == nil {
+		return ""
+	}
+	return formatNode(w.fset, n)
+}
+
+// replaced reports the replacement of the statement
+// with the source before to the trace and to the
+// Converted callback.
+func (w *rewriter) replaced(pos token.Pos, name, before string, after ast.Node) {
+	if w.opts.Converted != nil {
+		loop := after
+		if l, ok := after.(*ast.LabeledStmt); ok {
+			loop = l.Stmt
+		}
+		firstLine := func(s string) string { return strings.SplitN(s, "\n", 2)[0] }
+		w.opts.Converted(w.position(pos), name, firstLine(before), firstLine(formatNode(w.fset, loop)))
+	}
+	w.trace(pos, before, after)
+}
+
+// trace prints the source of the original statement
+// and of its replacement side by side to the trace
+// writer of the options. The entries are separated
+// by a blank line.
+//
+//   foo_test.go:4:12
+//   if err := testutil.WaitForResult(func() (bool, error) { | for r := retry.OneSec(); r.NextOr(t.FailNow); {
+//       return ready(), nil                                 |     if ready() {
+//   ...
+//
+func (w *rewriter) trace(pos token.Pos, before string, after ast.Node) {
+	if w.opts.Trace == nil {
+		return
+	}
+	fmt.Fprintf(w.opts.Trace, "%s\n%s\n", w.position(pos), sideBySide(before, formatNode(w.fset, after)))
+}
+
+// sideBySide formats the lines of a and b in two
+// columns. Tabs are expanded to four spaces.
+func sideBySide(a, b string) string {
+	split := func(s string) []string {
+		return strings.Split(strings.ReplaceAll(s, "\t", "    "), "\n")
+	}
+	left, right := split(a), split(b)
+	width := 0
+	for _, l := range left {
+		width = max(width, len(l))
+	}
+	var buf bytes.Buffer
+	for i := 0; i < max(len(left), len(right)); i++ {
+		var l, r string
+		if i < len(left) {
+			l = left[i]
+		}
+		if i < len(right) {
+			r = right[i]
+		}
+		line := fmt.Sprintf("%-*s | %s", width, l, r)
+		buf.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,35 @@
+package transform
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	in := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Trace = &buf
+	if _, _, err := TransformFile("foo_test.go", []byte(in), opts); err != nil {
+		t.Fatal(err)
+	}
+	want := "foo_test.go:4:12\n" +
+		"if err := testutil.WaitForResult(func() (bool, error) { | for r := retry.OneSec(); r.NextOr(t.FailNow); {\n" +
+		"    return ready(), nil                                 |     if ready() {\n" +
+		"}); err != nil {                                        |         break\n" +
+		"    t.Fatal(err)                                        |     }\n" +
+		"}                                                       | }\n" +
+		"\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,401 @@
+// Package transform rewrites calls from WaitForResult to use
+// the retry package.
+//
+// It transforms from
+//
+//   if err := testutil.WaitForResult(func() (bool, error) {
+//       if err := foo(); err != nil {
+//           return false, fmt.Errorf("foo: %s", err)
+//       }
+//       return true, nil
+//   }); err != nil {
+//       t.Fatal(err)
+//   }
+//
+// to
+//
+//   for r := retry.OneSec(); r.NextOr(t.FailNow); {
+//       if err := foo(); err != nil {
+//           t.Logf("foo: %s", err)
+//           continue
+//       }
+//       break
+//   }
+//
+package transform
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/magiconair/wfr2retry/apply"
+)
+
+// DefaultRetryPkg is the import path of the retry package
+// which is used when Options.RetryPkg is empty.
+const DefaultRetryPkg = "github.com/hashicorp/consul/sdk/testutil/retry"
+
+// Options controls the rewrite. The zero value is valid
+// but DefaultOptions has the defaults of the command.
+// The options are passed by value to the rewriter of each
+// file so that files can be transformed concurrently with
+// different options.
+type Options struct {
+	// RetryPkg is the import path of the retry package.
+	// DefaultRetryPkg is used if it is empty.
+	RetryPkg string
+
+	// RetryAlias is the optional local name of the
+	// retry package.
+	RetryAlias string
+
+	// Timeout is the timeout of the retry.Timer which
+	// is used instead of retry.OneSec() if it is set.
+	Timeout time.Duration
+
+	// Attempts is the number of attempts of the
+	// retry.Counter which is used instead of
+	// retry.OneSec() if it is set. It cannot be
+	// combined with a Timeout.
+	Attempts int
+
+	// Wait is the poll interval of the retry.Timer
+	// and the retry.Counter.
+	Wait time.Duration
+
+	// RetryAPI selects the method set of the retryer.
+	//
+	//   v1: r.NextOr(t.FailNow)
+	//   v2: r.NextOr(t, t.FailNow)
+	//
+	// The default is v1.
+	RetryAPI string
+
+	// NilMessage is logged when a callback signals a retry
+	// without an error value, e.g. 'return false, nil'.
+	// Nothing is logged if it is empty.
+	NilMessage string
+
+	// BoolMessage is logged when a callback which returns
+	// only a bool returns false. The NilMessage is used
+	// if it is empty.
+	BoolMessage string
+
+	// ErrorfFuncs are the names of printf-style error
+	// constructors like 'errf' or 'errors.Newf' whose
+	// arguments are logged with t.Logf like the ones
+	// of fmt.Errorf. Other calls are logged as they are.
+	ErrorfFuncs []string
+
+	// Inline inlines local callback functions which are
+	// only used by WaitForResult.
+	Inline bool
+
+	// MergeAdjacent merges adjacent loops with the same
+	// retryer into a single loop which checks all
+	// conditions in every attempt.
+	MergeAdjacent bool
+
+	// NoHoist keeps the setup statements of the
+	// callback in the loop.
+	NoHoist bool
+
+	// Defer controls the handling of defer statements in
+	// callbacks. In the loop the deferred calls run at the
+	// end of the test instead of at the end of each attempt.
+	//
+	//   hoist: move leading defer statements before the loop
+	//   keep:  keep the defer statements in the loop
+	//   warn:  keep the defer statements and print a warning
+	//
+	// The default is warn.
+	Defer string
+
+	// ReturnErr controls the handling of calls whose
+	// error check returns the error instead of failing
+	// the test, e.g. in a helper which returns an error.
+	//
+	//   warn:    keep the call and print a warning
+	//   convert: convert the call and fail the test
+	//
+	// The default is warn.
+	ReturnErr string
+
+	// Format controls the formatting of the output.
+	//
+	//   none:  format only the changed declarations
+	//   gofmt: format the whole file
+	//
+	// The default is none.
+	Format string
+
+	// Match are the forms of the calls which are converted:
+	// waitforresult for (test*).WaitForResult and
+	// pollwaiton for poll.WaitOn of gotest.tools. Only
+	// WaitForResult calls are converted if it is empty.
+	Match []string
+
+	// Packages are the names of the packages whose
+	// WaitForResult functions are converted, e.g. testutil.
+	// Calls of other packages, methods and unqualified
+	// calls are left as they are. All calls are converted
+	// if it is empty.
+	Packages []string
+
+	// TabWidth is the width of a tab of the printer.
+	// The default of gofmt is used if it is zero.
+	TabWidth int
+
+	// UseSpaces indents the output with spaces
+	// instead of tabs.
+	UseSpaces bool
+
+	// AssertPkgs are the names of assertion packages like
+	// testify's assert and require whose functions take the
+	// *testing.T as first argument.
+	AssertPkgs []string
+
+	// NoReceiverSwap keeps the NoError assertions of the
+	// *testing.T in callbacks which then fail the test on
+	// the first error instead of ending the attempt.
+	NoReceiverSwap bool
+
+	// Verify type checks the file before and after the
+	// rewrite and reports the type errors which only
+	// occur after it. The file is checked on its own.
+	Verify bool
+
+	// Warnings receives the warnings about callbacks
+	// which need to be checked by hand.
+	Warnings io.Writer
+
+	// Log receives the decisions of the rewrite.
+	Log io.Writer
+
+	// Skipped is called with the position and the reason
+	// of every WaitForResult call which is not converted
+	// and not reported as an error.
+	Skipped func(pos token.Position, reason string)
+
+	// Converted is called with the position and the name
+	// of every converted call and the first line of the
+	// statement before and after the rewrite.
+	Converted func(pos token.Position, name, before, after string)
+
+	// ASTAfter receives the AST after the rewrite.
+	ASTAfter io.Writer
+
+	// Trace receives the source of every replaced
+	// statement next to its replacement.
+	Trace io.Writer
+}
+
+// DefaultOptions returns the options with the
+// defaults of the command.
+func DefaultOptions() Options {
+	return Options{
+		RetryPkg:    DefaultRetryPkg,
+		RetryAPI:    "v1",
+		Wait:        25 * time.Millisecond,
+		BoolMessage: "condition not met",
+		Defer:       "warn",
+		ReturnErr:   "warn",
+		Format:      "none",
+		AssertPkgs:  []string{"assert", "require"},
+		Match:       []string{"waitforresult"},
+	}
+}
+
+// check returns an error if the options are invalid.
+func (o Options) check() error {
+	switch o.Defer {
+	case "", "hoist", "keep", "warn":
+	default:
+		return fmt.Errorf("invalid defer mode %q", o.Defer)
+	}
+	if err := checkMatch(o.Match); err != nil {
+		return err
+	}
+	if o.Attempts < 0 {
+		return fmt.Errorf("invalid number of attempts %d", o.Attempts)
+	}
+	if o.Attempts > 0 && o.Timeout > 0 {
+		return fmt.Errorf("attempts and timeout cannot be combined")
+	}
+	if o.TabWidth < 0 {
+		return fmt.Errorf("invalid tab width %d", o.TabWidth)
+	}
+	switch o.ReturnErr {
+	case "", "warn", "convert":
+	default:
+		return fmt.Errorf("invalid return-err mode %q", o.ReturnErr)
+	}
+	switch o.RetryAPI {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("invalid retry api %q", o.RetryAPI)
+	}
+	switch o.Format {
+	case "", "none", "gofmt":
+	default:
+		return fmt.Errorf("invalid format %q", o.Format)
+	}
+	return nil
+}
+
+// printer returns the configuration of the printer or nil
+// if the output is formatted like gofmt.
+func (o Options) printer() *printer.Config {
+	if o.TabWidth == 0 && !o.UseSpaces {
+		return nil
+	}
+	cfg := &printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if o.TabWidth > 0 {
+		cfg.Tabwidth = o.TabWidth
+	}
+	if o.UseSpaces {
+		cfg.Mode = printer.UseSpaces
+	}
+	return cfg
+}
+
+// Transform rewrites the WaitForResult calls in the source
+// of a Go file and returns the formatted source.
+func Transform(src []byte, opts Options) ([]byte, error) {
+	out, _, err := TransformFile("", src, opts)
+	return out, err
+}
+
+// TransformFile rewrites the WaitForResult calls in the
+// source of the file fname and returns the formatted source
+// and the number of converted calls. fname is only used for
+// the positions in errors and messages. Files without
+// WaitForResult calls are returned unchanged.
+func TransformFile(fname string, in []byte, opts Options) ([]byte, int, error) {
+	if err := opts.check(); err != nil {
+		return nil, 0, err
+	}
+
+	// parse input
+	fset := token.NewFileSet()
+	root, err := parser.ParseFile(fset, fname, in, parser.ParseComments)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// nothing to do
+	if !(opts.matches("waitforresult") && hasWFR(root, opts.Packages)) && !(opts.matches("pollwaiton") && hasPoll(root)) {
+		return in, 0, nil
+	}
+
+	if opts.Warnings != nil {
+		warnOuterState(fset, root, opts.Packages, opts.Warnings)
+		warnAssertions(fset, root, opts.Packages, opts.AssertPkgs, !opts.NoReceiverSwap, opts.Warnings)
+		warnTestMethods(fset, root, opts.Packages, opts.Warnings)
+	}
+
+	// remember the original declarations to
+	// detect the ones changed by the rewrite.
+	orig, err := printDecls(fset, root, opts.printer())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// apply transformation
+	//
+	// The rewrite runs after the children of a node have been
+	// visited so that nested WaitForResult calls in a callback
+	// are converted before the callback itself.
+	used, tu := usedImports(root), wfrImport(root, opts.Packages)
+	w := newRewriter(fset, root, opts)
+	var n int
+	apply.Apply(root, nil, func(c apply.ApplyCursor) bool {
+		if w.rewrite(c) {
+			n++
+		}
+		return true
+	})
+	if err := w.errs.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if opts.MergeAdjacent {
+		w.mergeLoops(root)
+	}
+
+	// drop the declarations of inlined callbacks
+	if opts.Inline {
+		removeUnusedFuncs(fset, root)
+	}
+
+	// drop the imports which are no longer used
+	// and add the retry import if it is now needed.
+	fixImports(root, opts, tu, used)
+
+	if opts.ASTAfter != nil {
+		if err := ast.Fprint(opts.ASTAfter, fset, root, ast.NotNilFilter); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var out []byte
+	if opts.Format == "gofmt" {
+		out, err = formatFile(fset, root, opts.printer())
+	} else {
+		// format the changed declarations and keep
+		// the rest of the code as is.
+		out, err = spliceDecls(fset, root, in, orig, opts.printer())
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if opts.Verify {
+		if err := verify(fname, in, out); err != nil {
+			return nil, 0, err
+		}
+	}
+	return out, n, nil
+}
+
+// List returns the locations of the WaitForResult and
+// WaitForResultRetries calls in the source of the file
+// fname in the form 'file:line: name'.
+func List(fname string, src []byte) ([]string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, fname, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	var calls []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		if c, ok := n.(*ast.CallExpr); ok {
+			if name := funcName(c.Fun); name == "WaitForResult" || name == "WaitForResultRetries" {
+				p := fset.Position(c.Pos())
+				calls = append(calls, fmt.Sprintf("%s:%d: %s", p.Filename, p.Line, name))
+			}
+		}
+		return true
+	})
+	return calls, nil
+}
+
+// hasWFR reports whether the file contains a
+// (test*).WaitForResult or similar call of one
+// of the packages.
+func hasWFR(f *ast.File, pkgs []string) bool {
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if c, ok := n.(*ast.CallExpr); ok && strings.HasPrefix(funcName(c.Fun), "WaitForResult") && inPkgs(c.Fun, pkgs) {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,3720 @@
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRewriteBody(t *testing.T) {
+
+	tests := []struct {
+		desc, in, out string
+	}{
+		{
+			"empty body",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				break
+			}
+			`,
+		},
+		{
+			"if with t.Fatal",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if foo == bar {
+					t.Fatal(err)
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if foo == bar {
+					t.Fatal(err)
+				}
+				break
+			}
+			`,
+		},
+		{
+			"if with t.Logf and t.Helper",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				t.Helper()
+				if foo != bar {
+					t.Logf("got %s want %s", foo, bar)
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			t.Helper()
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if foo != bar {
+					t.Logf("got %s want %s", foo, bar)
+				}
+				break
+			}
+			`,
+		},
+		{
+			"hoist setup statements",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				t.Helper()
+				want := 3
+				var got int
+				got = len(members())
+				return got == want, fmt.Errorf("got %d want %d", got, want)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			t.Helper()
+			want := 3
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				var got int
+				got = len(members())
+				if got == want {
+					break
+				}
+				t.Logf("got %d want %d", got, want)
+			}
+			`,
+		},
+		{
+			"fmt.Errorf with %w",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if err := ping(); err != nil {
+					return false, fmt.Errorf("ping %d%%: %w", n, err)
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := ping(); err != nil {
+					t.Logf("ping %d%%: %v", n, err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"fmt.Errorf without args",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if !ready() {
+					return false, fmt.Errorf("not ready")
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if !ready() {
+					t.Log("not ready")
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"fmt.Errorf with verb and without args",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if !ready() {
+					return false, fmt.Errorf("100%% not ready: %s")
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if !ready() {
+					t.Logf("100%% not ready: %s")
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"return in else",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if ready() {
+					log.Print("ready")
+				} else {
+					return false, err
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if ready() {
+					log.Print("ready")
+				} else {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"log before return in if",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if !ready() {
+					t.Log("not ready")
+					return false, nil
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if !ready() {
+					t.Log("not ready")
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"return in range and switch",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				for _, s := range servers {
+					switch s.State() {
+					case "leader":
+						return true, nil
+					case "":
+						return false, fmt.Errorf("%s: no state", s)
+					}
+				}
+				return false, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			retry:
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				for _, s := range servers {
+					switch s.State() {
+					case "leader":
+						break retry
+					case "":
+						t.Logf("%s: no state", s)
+						continue retry
+					}
+				}
+				continue
+			}
+			`,
+		},
+		{
+			"check all members in range",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				for _, m := range members {
+					if !m.Ready {
+						return false, fmt.Errorf("%s not ready", m.Name)
+					}
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			retry:
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				for _, m := range members {
+					if !m.Ready {
+						t.Logf("%s not ready", m.Name)
+						continue retry
+					}
+				}
+				break
+			}
+			`,
+		},
+		{
+			"return in switch",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				switch state {
+				case ready:
+					return true, nil
+				default:
+					return false, err
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			retry:
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				switch state {
+				case ready:
+					break retry
+				default:
+					t.Log(err)
+					continue
+				}
+			}
+			`,
+		},
+		{
+			"labeled loop followed by wfr with local fn",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				switch state {
+				case ready:
+					return true, nil
+				default:
+					return false, err
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := testutil.WaitForResult(g); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			retry:
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				switch state {
+				case ready:
+					break retry
+				default:
+					t.Log(err)
+					continue
+				}
+			}
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := g(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"return in type switch",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				switch x := v.(type) {
+				case error:
+					return false, x
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				switch x := v.(type) {
+				case error:
+					t.Log(x)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"return in labeled loop",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+			outer:
+				for _, s := range servers {
+					for _, m := range s.members() {
+						if m == "" {
+							continue outer
+						}
+						if !m.ready() {
+							return false, nil
+						}
+					}
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			retry:
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+			outer:
+				for _, s := range servers {
+					for _, m := range s.members() {
+						if m == "" {
+							continue outer
+						}
+						if !m.ready() {
+							continue retry
+						}
+					}
+				}
+				break
+			}
+			`,
+		},
+		{
+			"require.NoError in callback",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				require.NoError(t, ping())
+				for _, s := range servers {
+					assert.NoError(t, s.Ping())
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			retry:
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := ping(); err != nil {
+					t.Log(err)
+					continue
+				}
+				for _, s := range servers {
+					if err := s.Ping(); err != nil {
+						t.Log(err)
+						continue retry
+					}
+				}
+				break
+			}
+			`,
+		},
+		{
+			"errors.Wrap",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if err := ping(); err != nil {
+					return false, errors.Wrap(err, "ping")
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := ping(); err != nil {
+					t.Log(errors.Wrap(err, "ping"))
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"parenthesized condition",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if ((n == 0)) {
+					return (false), nil
+				}
+				return ((n > 3)), fmt.Errorf("got %d", n)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if n == 0 {
+					continue
+				}
+				if n > 3 {
+					break
+				}
+				t.Logf("got %d", n)
+			}
+			`,
+		},
+		{
+			"nil check of error",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				_, err := ping()
+				return err == nil, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				_, err := ping()
+				if err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"reversed nil check of call",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return nil == ping(), nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := ping(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"bool callback",
+			`
+			if err := testutil.WaitForResult(func() bool {
+				if !ready() {
+					return false
+				}
+				return n > 3
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if !ready() {
+					t.Log("condition not met")
+					continue
+				}
+				if n > 3 {
+					break
+				}
+				t.Log("condition not met")
+			}
+			`,
+		},
+		{
+			"bool callback with named result",
+			`
+			if err := testutil.WaitForResult(func() (ok bool) {
+				ok = ready()
+				return
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				var ok bool
+				ok = ready()
+				if ok {
+					break
+				}
+				t.Log("condition not met")
+			}
+			`,
+		},
+		{
+			"keep setup of modified variables",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				n := 0
+				for _, m := range members() {
+					n++
+				}
+				return n > 3, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				n := 0
+				for _, m := range members() {
+					n++
+				}
+				if n > 3 {
+					break
+				}
+			}
+			`,
+		},
+		{
+			"keep polled reads in the loop",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				leader := srv.isLeader
+				n := *count
+				v := state[key]
+				return leader && n > 0 && v != "", nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				leader := srv.isLeader
+				n := *count
+				v := state[key]
+				if leader && n > 0 && v != "" {
+					break
+				}
+			}
+			`,
+		},
+		{
+			"keep setup of names used outside",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				want := 3
+				return len(members()) == want, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			want := 4
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				want := 3
+				if len(members()) == want {
+					break
+				}
+			}
+			want := 4
+			`,
+		},
+		{
+			"keep assignments of outer variables",
+			`
+			var got string
+			if err := testutil.WaitForResult(func() (bool, error) {
+				got = ""
+				got = fetch()
+				return got != "", nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			use(got)
+			`,
+			`
+			var got string
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				got = ""
+				got = fetch()
+				if got != "" {
+					break
+				}
+			}
+			use(got)
+			`,
+		},
+		{
+			"return with binary expr",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			`,
+		},
+		{
+			"return with less than",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return len(x) < 3, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if len(x) < 3 {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with less or equal",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return len(x) <= 3, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if len(x) <= 3 {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with not equal",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return a != b, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if a != b {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with logical and",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return a > 0 && b == nil, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if a > 0 && b == nil {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with logical or",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return a > 0 || b == nil, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if a > 0 || b == nil {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with mixed logical ops",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return (a > 0 && b == nil) || !c, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if (a > 0 && b == nil) || !c {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with negation",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return !done, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if !done {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with bool var",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return ok, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if ok {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with bool var in if",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				ready, err := probe()
+				if err != nil {
+					return ready, err
+				}
+				return ready, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				ready, err := probe()
+				if err != nil {
+					if ready {
+						break
+					}
+					t.Log(err)
+					continue
+				}
+				if ready {
+					break
+				}
+			}
+			`,
+		},
+		{
+			"early success return",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if cached() {
+					return true, nil
+				}
+				if err := refresh(); err != nil {
+					return false, err
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if cached() {
+					break
+				}
+				if err := refresh(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"chained selectors",
+			`
+			if err := s.cluster.WaitForResult(func() (bool, error) {
+				if !s.cluster.Ready() {
+					return false, s.suite.t.Fatalf("not ready")
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if !s.cluster.Ready() {
+					t.Log(s.suite.t.Fatalf("not ready"))
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"testing handle in a field",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				s.t.Helper()
+				if err := s.srv.Ping(); err != nil {
+					return false, err
+				}
+				require.NoError(s.t, s.srv.Ready())
+				return true, nil
+			}); err != nil {
+				s.t.Fatalf("server not ready: %v", err)
+			}
+			`,
+			`
+			s.t.Helper()
+			for r := retry.OneSec(); r.NextOr(s.t.FailNow); {
+				if err := s.srv.Ping(); err != nil {
+					s.t.Log(err)
+					continue
+				}
+				if err := s.srv.Ready(); err != nil {
+					s.t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"r used in the callback",
+			`
+			r := strings.NewReader(data)
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return r.Len() == 0, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			r := strings.NewReader(data)
+			for rr := retry.OneSec(); rr.NextOr(t.FailNow); {
+				if r.Len() == 0 {
+					break
+				}
+			}
+			`,
+		},
+		{
+			"if with return expr",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if x != nil {
+					n := len(x)
+					return n < 3, fmt.Errorf("got %d", n)
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x != nil {
+					n := len(x)
+					if n < 3 {
+						break
+					}
+					t.Logf("got %d", n)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"if with return false and nil",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if !ready() {
+					return false, nil
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if !ready() {
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"return false with nil",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				foo()
+				return false, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				foo()
+				continue
+			}
+			`,
+		},
+		{
+			"return false with err",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				err := foo()
+				return false, err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				err := foo()
+				t.Log(err)
+				continue
+			}
+			`,
+		},
+		{
+			"return false with unqualified call",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				return false, newErr()
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				t.Log(newErr())
+				continue
+			}
+			`,
+		},
+		{
+			"guarded success before failure",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if leader() != "" {
+					t.Log("leader elected")
+					return true, nil
+				}
+				elect()
+				return false, fmt.Errorf("no leader")
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if leader() != "" {
+					t.Log("leader elected")
+					break
+				}
+				elect()
+				t.Log("no leader")
+				continue
+			}
+			`,
+		},
+		{
+			"returns in else branches",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if n := count(); n == 0 {
+					return false, nil
+				} else if n > 3 {
+					if done() {
+						return true, nil
+					}
+					return n > 5, fmt.Errorf("got %d", n)
+				} else {
+					return true, nil
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if n := count(); n == 0 {
+					continue
+				} else if n > 3 {
+					if done() {
+						break
+					}
+					if n > 5 {
+						break
+					}
+					t.Logf("got %d", n)
+					continue
+				} else {
+					break
+				}
+			}
+			`,
+		},
+		{
+			"bare return",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if !done {
+					return
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if !done {
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"bare return with named results",
+			`
+			if err := testutil.WaitForResult(func() (ok bool, err error) {
+				ok, err = check()
+				if err != nil {
+					return
+				}
+				ok = ok && ready()
+				return
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				var ok bool
+				var err error
+				ok, err = check()
+				if err != nil {
+					if ok {
+						break
+					}
+					t.Log(err)
+					continue
+				}
+				ok = ok && ready()
+				if ok {
+					break
+				}
+				t.Log(err)
+			}
+			`,
+		},
+		{
+			"return with single value",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				err := foo()
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				err := foo()
+				if err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"return of (bool, error) helper",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				t.Log("checking")
+				return checkSomething()
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				t.Log("checking")
+				if ok, err := checkSomething(); !ok {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"return of (bool, error) helper in if",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if leader {
+					return checkLeader()
+				}
+				return checkFollower()
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if leader {
+					if ok, err := checkLeader(); !ok {
+						t.Log(err)
+						continue
+					}
+					break
+				}
+				if ok, err := checkFollower(); !ok {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"nested wfr",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if err := testutil.WaitForResult(func() (bool, error) {
+					if err := testutil.WaitForResult(g); err != nil {
+						t.Fatal(err)
+					}
+					return x > 0, "inner"
+				}); err != nil {
+					t.Fatal(err)
+				}
+				return y > 0, "outer"
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				for r2 := retry.OneSec(); r2.NextOr(t.FailNow); {
+					for r3 := retry.OneSec(); r3.NextOr(t.FailNow); {
+						if err := g(); err != nil {
+							t.Log(err)
+							continue
+						}
+						break
+					}
+					if x > 0 {
+						break
+					}
+					t.Log("inner")
+				}
+				if y > 0 {
+					break
+				}
+				t.Log("outer")
+			}
+			`,
+		},
+		{
+			"nested wfr with two levels",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if err := testutil.WaitForResult(g); err != nil {
+					t.Fatal(err)
+				}
+				return y > 0, "outer"
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				for r2 := retry.OneSec(); r2.NextOr(t.FailNow); {
+					if err := g(); err != nil {
+						t.Log(err)
+						continue
+					}
+					break
+				}
+				if y > 0 {
+					break
+				}
+				t.Log("outer")
+			}
+			`,
+		},
+		{
+			"wfr with local fn",
+			`
+			g := func() (bool, error) { return true, nil }
+			if err := testutil.WaitForResult(g); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			g := func() (bool, error) { return true, nil }
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := g(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"wfr with method value",
+			`
+			if err := testutil.WaitForResult(srv.checkReady); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := srv.checkReady(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"multi-step checks",
+			`
+			if err := testutil.WaitForResult(func() (bool, error) {
+				x, err := op()
+				if err != nil {
+					return false, err
+				}
+				if x != want {
+					return false, fmt.Errorf("got %v want %v", x, want)
+				}
+				return true, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				x, err := op()
+				if err != nil {
+					t.Log(err)
+					continue
+				}
+				if x != want {
+					t.Logf("got %v want %v", x, want)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"wfr with require.NoError",
+			`
+			err := testutil.WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			})
+			require.NoError(t, err)
+			foo()
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			foo()
+			`,
+		},
+		{
+			"wfr with require.NoError on other error",
+			`
+			err := testutil.WaitForResult(g)
+			require.NoError(t, err2)
+			testutil.WaitForResult(g)
+			`,
+			`
+			err := testutil.WaitForResult(g)
+			require.NoError(t, err2)
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := g(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"wfr with assignment",
+			`
+			var err error
+			if err = testutil.WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			var err error
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			`,
+		},
+		{
+			"wfr with custom error name",
+			`
+			if waitErr := testutil.WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			}); waitErr != nil {
+				t.Fatal(waitErr)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			`,
+		},
+		{
+			"wfr in if condition",
+			`
+			if testutil.WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			}) != nil {
+				t.Fatal("no x")
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			`,
+		},
+		{
+			"wfr with else branch",
+			`
+			if err := testutil.WaitForResult(g); err != nil {
+				t.Fatal(err)
+			} else {
+				t.Log("ok")
+			}
+			testutil.WaitForResult(g)
+			`,
+			`
+			if err := testutil.WaitForResult(g); err != nil {
+				t.Fatal(err)
+			} else {
+				t.Log("ok")
+			}
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := g(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"wfr with mismatched error check",
+			`
+			if waitErr := testutil.WaitForResult(g); err != nil {
+				t.Fatal(waitErr)
+			}
+			testutil.WaitForResult(g)
+			`,
+			`
+			if waitErr := testutil.WaitForResult(g); err != nil {
+				t.Fatal(waitErr)
+			}
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := g(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"wfr with non-ident error",
+			`
+			if s.err = testutil.WaitForResult(g); s.err != nil {
+				t.Fatal(s.err)
+			}
+			testutil.WaitForResult(g)
+			`,
+			`
+			if s.err = testutil.WaitForResult(g); s.err != nil {
+				t.Fatal(s.err)
+			}
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := g(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"wfr with local fn and assignment",
+			`
+			var err error
+			if err = testutil.WaitForResult(g); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			var err error
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if err := g(); err != nil {
+					t.Log(err)
+					continue
+				}
+				break
+			}
+			`,
+		},
+		{
+			"standalone wfr",
+			`
+			testutil.WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			})
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			`,
+		},
+		{
+			"dot-imported wfr",
+			`
+			if err := WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			}); err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			`,
+		},
+		{
+			"wfr with split check",
+			`
+			err := testutil.WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			foo()
+			`,
+			`
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			foo()
+			`,
+		},
+		{
+			"wfr with split check and later use of err",
+			`
+			err := testutil.WaitForResult(func() (bool, error) {
+				return x > 0, "foo"
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = stop()
+			if err != nil {
+				t.Fatal(err)
+			}
+			`,
+			`
+			var err error
+			for r := retry.OneSec(); r.NextOr(t.FailNow); {
+				if x > 0 {
+					break
+				}
+				t.Log("foo")
+			}
+			err = stop()
+			if err != nil {
+				t.Fatal(err)
+			}
+			`,
+		},
+	}
+
+	clean := func(s string) string {
+		s = strings.Trim(s, " \n")
+		s = strings.Replace(s, "\t", "", -1)     // drop all tabs
+		s = strings.Replace(s, "\n\n", "\n", -1) // replace newlines with ;
+		s = strings.Replace(s, "\n", ";", -1)    // replace newlines with ;
+		s = strings.Replace(s, "{;", "{ ", -1)
+		s = strings.Replace(s, ";}", " }", -1)
+		s = strings.Replace(s, "};", "} ", -1)
+		s = strings.Replace(s, ";;", ";", -1)
+		return s
+	}
+
+	wrap := func(s string) string {
+		return "package foo\nfunc f(t *testing.T) {\n" + s + "}"
+	}
+
+	wrapOut := func(s string) string {
+		return "package foo\nimport \"" + DefaultRetryPkg + "\"\nfunc f(t *testing.T) {\n" + s + "}"
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			data, _, err := TransformFile("src.go", []byte(wrap(tt.in)), DefaultOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := clean(string(data)), clean(wrapOut(tt.out)); got != want {
+				t.Fatalf("got \n%q\nwant\n%q\n", got, want)
+			}
+		})
+	}
+}
+
+// TestEmittedAST verifies that the generated code re-parses
+// into the same node structure that the rewrite emits.
+func TestEmittedAST(t *testing.T) {
+	src := `package foo
+	func f(t *testing.T) {
+		g := func() (bool, error) { return true, nil }
+		if err := testutil.WaitForResult(g); err != nil {
+			t.Fatal(err)
+		}
+	}`
+
+	data, _, err := TransformFile("src.go", []byte(src), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "src.go", data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var loop *ast.ForStmt
+	ast.Inspect(f, func(n ast.Node) bool {
+		if x, ok := n.(*ast.ForStmt); ok {
+			loop = x
+		}
+		return loop == nil
+	})
+	if loop == nil {
+		t.Fatal("no for loop")
+	}
+	init, ok := loop.Init.(*ast.AssignStmt)
+	if !ok {
+		t.Fatalf("got init %T want *ast.AssignStmt", loop.Init)
+	}
+	call, ok := init.Rhs[0].(*ast.CallExpr)
+	if !ok {
+		t.Fatalf("got rhs %T want *ast.CallExpr", init.Rhs[0])
+	}
+	if _, ok := call.Fun.(*ast.SelectorExpr); !ok {
+		t.Fatalf("got fun %T want *ast.SelectorExpr", call.Fun)
+	}
+	if _, ok := loop.Body.List[0].(*ast.IfStmt).Body.List[0].(*ast.ExprStmt); !ok {
+		t.Fatalf("got %T want *ast.ExprStmt", loop.Body.List[0].(*ast.IfStmt).Body.List[0])
+	}
+}
+
+func TestASTAfter(t *testing.T) {
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.ASTAfter = &buf
+
+	src := `package foo
+	func f(t *testing.T) {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}`
+	if _, _, err := TransformFile("src.go", []byte(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, s := range []string{"*ast.ForStmt", `Name: "OneSec"`, `Name: "NextOr"`, "Tok: break"} {
+		if !strings.Contains(got, s) {
+			t.Fatalf("ast does not contain %q:\n%s", s, got)
+		}
+	}
+	if strings.Contains(got, "WaitForResult") {
+		t.Fatalf("ast contains WaitForResult:\n%s", got)
+	}
+}
+
+func TestPreserveUntouchedCode(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+var (
+	a = 1
+	bbbb = 2
+)
+
+func helper()   int { return a+bbbb }
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return helper() > 2, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBar is not converted.
+func TestBar(t *testing.T) {
+	x := helper()
+	_ =  x
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+var (
+	a = 1
+	bbbb = 2
+)
+
+func helper()   int { return a+bbbb }
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if helper() > 2 {
+			break
+		}
+	}
+}
+
+// TestBar is not converted.
+func TestBar(t *testing.T) {
+	x := helper()
+	_ =  x
+}
+`
+	got, _, err := TransformFile("foo_test.go", []byte(in), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Log = &buf
+
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	x := f(testutil.WaitForResult(g))
+}
+`
+	if _, _, err := TransformFile("foo_test.go", []byte(src), opts); err != nil {
+		t.Fatal(err)
+	}
+	want := "foo_test.go:4:12: WaitForResult call in *ast.IfStmt matched with callback *ast.FuncLit\n" +
+		"foo_test.go:4:12: replaced with 'for r := retry.OneSec(); r.NextOr(t.FailNow) {...}'\n" +
+		"foo_test.go:9:9: WaitForResult call in *ast.AssignStmt not converted: unsupported form\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnsupportedArgType(t *testing.T) {
+	src := `package foo
+	func f(t *testing.T) {
+		if err := testutil.WaitForResult(check()); err != nil {
+			t.Fatal(err)
+		}
+	}`
+
+	_, _, err := TransformFile("src.go", []byte(src), DefaultOptions())
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if got, want := err.Error(), "*ast.CallExpr"; !strings.Contains(got, want) {
+		t.Fatalf("got %q want error containing %q", got, want)
+	}
+}
+
+func TestRewriteErrors(t *testing.T) {
+	tests := []struct {
+		desc, src string
+		errs      []string
+	}{
+		{
+			"unsupported arg types",
+			`package foo
+			func f(t *testing.T) {
+				if err := testutil.WaitForResult(check()); err != nil {
+					t.Fatal(err)
+				}
+				testutil.WaitForResult(checks[0])
+			}`,
+			[]string{
+				"src.go:3:38: invalid WaitForResult arg type: *ast.CallExpr",
+				"src.go:6:28: invalid WaitForResult arg type: *ast.IndexExpr",
+			},
+		},
+		{
+			"arg which is not a function",
+			`package foo
+			const ready = true
+			func f(t *testing.T) {
+				if err := testutil.WaitForResult(nil); err != nil {
+					t.Fatal(err)
+				}
+				testutil.WaitForResult(ready)
+			}`,
+			[]string{
+				"src.go:4:38: invalid WaitForResult arg nil: not a function",
+				"src.go:7:28: invalid WaitForResult arg ready: not a function",
+			},
+		},
+		{
+			"unsupported result type",
+			`package foo
+			func f(t *testing.T) {
+				testutil.WaitForResult(func() (bool, error) {
+					return 1, nil
+				})
+			}`,
+			[]string{
+				"src.go:4:13: unsupported result type *ast.BasicLit",
+			},
+		},
+		{
+			"unsupported results in nested blocks",
+			`package foo
+			func f(t *testing.T) {
+				testutil.WaitForResult(func() (bool, error) {
+					if x.ok {
+						return xs[1:], nil
+					} else if x.done {
+						return v.(bool), nil
+					}
+					return true, nil
+				})
+			}`,
+			[]string{
+				"src.go:5:14: unsupported result type *ast.SliceExpr",
+				"src.go:7:14: unsupported result type *ast.TypeAssertExpr",
+			},
+		},
+		{
+			"parse error",
+			`package foo
+			func f(t *testing.T) {
+				testutil.WaitForResult(func() (bool, error) {
+			}`,
+			[]string{
+				"src.go:4:5: missing ',' before newline in argument list",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, _, err := TransformFile("src.go", []byte(tt.src), DefaultOptions())
+			list, ok := err.(scanner.ErrorList)
+			if !ok {
+				t.Fatalf("got %T want scanner.ErrorList", err)
+			}
+			var got []string
+			for _, e := range list {
+				got = append(got, e.Error())
+			}
+			if !reflect.DeepEqual(got, tt.errs) {
+				t.Fatalf("got %q want %q", got, tt.errs)
+			}
+		})
+	}
+}
+
+func TestComments(t *testing.T) {
+	in := `package foo
+
+import "github.com/hashicorp/consul/testutil"
+
+func TestFoo(t *testing.T) {
+	// wait for the leader
+	if err := testutil.WaitForResult(func() (bool, error) {
+		// explain why we wait
+		if foo != bar { // not yet
+			return false, fmt.Errorf("boom")
+		}
+		return true, nil
+	}); err != nil {
+		// this should not happen
+		t.Fatalf("leader: %v", err) // no leader
+	} // leader elected
+}
+`
+	out := `package foo
+
+import "github.com/hashicorp/consul/sdk/testutil/retry"
+
+func TestFoo(t *testing.T) {
+	// wait for the leader
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		// explain why we wait
+		if foo != bar { // not yet
+			t.Log("boom")
+			continue
+		}
+		break
+	} // leader elected
+}
+`
+	data, _, err := TransformFile("src.go", []byte(in), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), out; got != want {
+		t.Fatalf("got \n%s\nwant\n%s\n", got, want)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	tests := []struct {
+		desc          string
+		timeout, wait time.Duration
+		out           string
+	}{
+		{
+			"default", 0, 25 * time.Millisecond,
+			`package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		break
+	}
+}
+`,
+		},
+		{
+			"custom timer", 5 * time.Second, 100 * time.Millisecond,
+			`package foo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := (&retry.Timer{Timeout: 5 * time.Second, Wait: 100 * time.Millisecond}); r.NextOr(t.FailNow); {
+		break
+	}
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Timeout, opts.Wait = tt.timeout, tt.wait
+			data, _, err := TransformFile("src.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(data), tt.out; got != want {
+				t.Fatalf("got \n%s\nwant\n%s\n", got, want)
+			}
+		})
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := (&retry.Counter{Count: 20, Wait: 50 * time.Millisecond}); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+}
+`
+	opts := DefaultOptions()
+	opts.Attempts, opts.Wait = 20, 50*time.Millisecond
+	data, _, err := TransformFile("src.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), out; got != want {
+		t.Fatalf("got \n%s\nwant\n%s\n", got, want)
+	}
+
+	tests := []struct {
+		attempts int
+		timeout  time.Duration
+		err      string
+	}{
+		{-1, 0, "invalid number of attempts -1"},
+		{3, time.Second, "attempts and timeout cannot be combined"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.Attempts, opts.Timeout = tt.attempts, tt.timeout
+		if _, _, err := TransformFile("src.go", []byte(in), opts); err == nil || err.Error() != tt.err {
+			t.Fatalf("got error %v want %s", err, tt.err)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResultRetries(5, func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := (&retry.Counter{Count: 5, Wait: 25 * time.Millisecond}); r.NextOr(t.FailNow); {
+		break
+	}
+}
+`
+	got, n, err := TransformFile("foo_test.go", []byte(in), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d conversions want 1", n)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func TestGoroutine(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- testutil.WaitForResult(func() (bool, error) {
+			return ready(), nil
+		})
+	}()
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		testutil.WaitForResult(func() (bool, error) {
+			return ready(), nil
+		})
+	}()
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- testutil.WaitForResult(func() (bool, error) {
+			return ready(), nil
+		})
+	}()
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+	go func() {
+		testutil.WaitForResult(func() (bool, error) {
+			return ready(), nil
+		})
+	}()
+}
+`
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Warnings = &buf
+	got, n, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d conversions want 1", n)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+	want := "foo_test.go:22:3: warning: WaitForResult call in a goroutine not converted\n"
+	if buf.String() != want {
+		t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestHelperWithoutT(t *testing.T) {
+	in := `package foo
+
+func waitForLeader(srv *server) error {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return srv.leader() != "", nil
+	}); err != nil {
+		return fmt.Errorf("no leader: %v", err)
+	}
+	return nil
+}
+
+func waitForPeers(srv *server) {
+	testutil.WaitForResult(func() (bool, error) {
+		return len(srv.peers()) == 3, nil
+	})
+}
+`
+	var buf bytes.Buffer
+	var skipped []string
+	opts := DefaultOptions()
+	opts.Warnings = &buf
+	opts.ReturnErr = "convert"
+	opts.Skipped = func(pos token.Position, reason string) {
+		skipped = append(skipped, fmt.Sprintf("%s: %s", pos, reason))
+	}
+	got, n, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || string(got) != in {
+		t.Fatalf("got %d conversions\n%s\nwant the file unchanged", n, got)
+	}
+	want := "foo_test.go:4:12: warning: WaitForResult call in a function without a *testing.T not converted\n" +
+		"foo_test.go:13:2: warning: WaitForResult call in a function without a *testing.T not converted\n"
+	if buf.String() != want {
+		t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), want)
+	}
+	wantSkipped := []string{
+		"foo_test.go:4:12: no *testing.T in the function",
+		"foo_test.go:13:2: no *testing.T in the function",
+	}
+	if !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Fatalf("got skipped %v want %v", skipped, wantSkipped)
+	}
+}
+
+func TestSubtest(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(st *testing.T) {
+			if err := testutil.WaitForResult(func() (bool, error) {
+				if err := tt.check(); err != nil {
+					return false, err
+				}
+				return tt.ok, st.Fatalf("not ok: %s", tt.name)
+			}); err != nil {
+				st.Fatal(err)
+			}
+		})
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(st *testing.T) {
+			for r := retry.OneSec(); r.NextOr(st.FailNow); {
+				if err := tt.check(); err != nil {
+					st.Log(err)
+					continue
+				}
+				if tt.ok {
+					break
+				}
+				st.Logf("not ok: %s", tt.name)
+			}
+		})
+	}
+}
+`
+	got, _, err := TransformFile("foo_test.go", []byte(in), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func TestContextCallback(t *testing.T) {
+	tests := []struct {
+		desc, in, out string
+	}{
+		{
+			"used",
+			`package foo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func(ctx context.Context) (bool, error) {
+		return ready(ctx), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+			`package foo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		ctx := context.Background()
+		if ready(ctx) {
+			break
+		}
+	}
+}
+`,
+		},
+		{
+			"unused",
+			`package foo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func(ctx context.Context) (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`,
+			`package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, _, err := TransformFile("foo_test.go", []byte(tt.in), DefaultOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.out {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestTestingTB(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func waitForLeader(tb testing.TB) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		tb.Helper()
+		if err := ping(); err != nil {
+			return false, fmt.Errorf("ping: %v", err)
+		}
+		return leader() != "", tb.Fatalf("no leader")
+	}); err != nil {
+		tb.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func waitForLeader(tb testing.TB) {
+	tb.Helper()
+	for r := retry.OneSec(); r.NextOr(tb.FailNow); {
+		if err := ping(); err != nil {
+			tb.Logf("ping: %v", err)
+			continue
+		}
+		if leader() != "" {
+			break
+		}
+		tb.Log("no leader")
+	}
+}
+`
+	got, _, err := TransformFile("foo_test.go", []byte(in), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func TestNilMessage(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		if !ready() {
+			return false, nil
+		}
+		return len(s.Members()) > 1, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	tests := []struct {
+		desc, msg, out string
+	}{
+		{
+			"no message", "",
+			`package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if !ready() {
+			continue
+		}
+		if len(s.Members()) > 1 {
+			break
+		}
+	}
+}
+`,
+		},
+		{
+			"message", "not ready",
+			`package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if !ready() {
+			t.Log("not ready")
+			continue
+		}
+		if len(s.Members()) > 1 {
+			break
+		}
+		t.Log("not ready")
+	}
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.NilMessage = tt.msg
+			got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(got), "t.Log(nil)") {
+				t.Fatalf("got t.Log(nil) in\n%s", got)
+			}
+			if string(got) != tt.out {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestNoHoist(t *testing.T) {
+	opts := DefaultOptions()
+	opts.NoHoist = true
+
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		t.Helper()
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		t.Helper()
+		break
+	}
+}
+`
+	got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func TestDefer(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		defer cleanup()
+		c := connect()
+		defer c.Close()
+		return c.Ping(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	keep := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		defer cleanup()
+		c := connect()
+		defer c.Close()
+		if c.Ping() {
+			break
+		}
+	}
+}
+`
+	hoist := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	defer cleanup()
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		c := connect()
+		defer c.Close()
+		if c.Ping() {
+			break
+		}
+	}
+}
+`
+	tests := []struct {
+		mode, out, warn string
+	}{
+		{"keep", keep, ""},
+		{"warn", keep, "foo_test.go:11:3: warning: deferred call runs at the end of the test for every attempt\n" +
+			"foo_test.go:13:3: warning: deferred call runs at the end of the test for every attempt\n"},
+		{"hoist", hoist, "foo_test.go:13:3: warning: deferred call runs at the end of the test for every attempt\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := DefaultOptions()
+			opts.Defer, opts.Warnings = tt.mode, &buf
+			got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.out {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.out)
+			}
+			if buf.String() != tt.warn {
+				t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), tt.warn)
+			}
+		})
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		n, err := members()
+		if err != nil {
+			return false, err
+		}
+
+		// check the leader
+		if leader() == "" {
+			return false, fmt.Errorf("no leader")
+		}
+
+		return n == 3, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		n, err := members()
+		if err != nil {
+			t.Log(err)
+			continue
+		}
+
+		// check the leader
+		if leader() == "" {
+			t.Log("no leader")
+			continue
+		}
+
+		if n == 3 {
+			break
+		}
+	}
+}
+`
+	for _, format := range []string{"none", "gofmt"} {
+		t.Run(format, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = format
+			got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != out {
+				t.Fatalf("got\n%s\nwant\n%s", got, out)
+			}
+		})
+	}
+}
+
+func TestTimedCheck(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	// wait for the leader
+	if err := testutil.WaitForResult(func() (bool, error) {
+		if time.Since(start) > timeout {
+			return false, fmt.Errorf("too late")
+		}
+		return leader() != "", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	// wait for the leader
+	// TODO: the check depends on time. Verify the timeout of the retry.Timer.
+	for r := (&retry.Timer{Timeout: time.Second, Wait: 25 * time.Millisecond}); r.NextOr(t.FailNow); {
+		if time.Since(start) > timeout {
+			t.Log("too late")
+			continue
+		}
+		if leader() != "" {
+			break
+		}
+	}
+}
+`
+	// the limit of time.Since must not hide the time call
+	for _, limit := range []string{"timeout", "x"} {
+		in := strings.Replace(in, "> timeout", "> "+limit, 1)
+		out := strings.Replace(out, "> timeout", "> "+limit, 1)
+		got, _, err := TransformFile("foo_test.go", []byte(in), DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != out {
+			t.Fatalf("got\n%s\nwant\n%s", got, out)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return leader() != "", nil
+	}, "X ready"); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}, msg)
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	// X ready
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if leader() != "" {
+			break
+		}
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}, msg)
+}
+`
+	got, n, err := TransformFile("foo_test.go", []byte(in), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d conversions want 1", n)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func TestListCalls(t *testing.T) {
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.WaitForResultRetries(3, func() (bool, error) {
+		return testutil.WaitForResult(g) == nil, nil
+	})
+}
+`
+	got, err := List("foo_test.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"foo_test.go:4: WaitForResult",
+		"foo_test.go:10: WaitForResultRetries",
+		"foo_test.go:11: WaitForResult",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestCount(t *testing.T) {
+	src := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WaitForResult(g)
+	err := testutil.WaitForResult(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := foo(); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	_, n, err := TransformFile("src.go", []byte(src), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 3; got != want {
+		t.Fatalf("got %d converted calls want %d", got, want)
+	}
+}
+
+func TestSkipWithoutWFR(t *testing.T) {
+	src := "package foo\n\nfunc f()  {\n\tx:=1\n  _ = x\n}\n"
+	data, n, err := TransformFile("src.go", []byte(src), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("got %d converted calls want 0", n)
+	}
+	if got, want := string(data), src; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestInline(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Inline = true
+
+	in := `package foo
+
+func TestFoo(t *testing.T) {
+	check := func() (bool, error) {
+		if foo != bar {
+			return false, fmt.Errorf("got %s want %s", foo, bar)
+		}
+		return true, nil
+	}
+	if err := testutil.WaitForResult(check); err != nil {
+		t.Fatal(err)
+	}
+
+	other := func() (bool, error) { return true, nil }
+	other()
+	if err := testutil.WaitForResult(other); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import "github.com/hashicorp/consul/sdk/testutil/retry"
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if foo != bar {
+			t.Logf("got %s want %s", foo, bar)
+			continue
+		}
+		break
+	}
+
+	other := func() (bool, error) { return true, nil }
+	other()
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if err := other(); err != nil {
+			t.Log(err)
+			continue
+		}
+		break
+	}
+}
+`
+	data, _, err := TransformFile("src.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), out; got != want {
+		t.Fatalf("got \n%s\nwant\n%s\n", got, want)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	src := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		break
+	}
+}
+`
+	// the zero value is usable
+	got, err := Transform([]byte(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+
+	if _, err := Transform([]byte(src), Options{Defer: "drop"}); err == nil {
+		t.Fatal("want error for invalid defer mode")
+	}
+	if _, err := Transform([]byte(src), Options{Format: "goimports"}); err == nil {
+		t.Fatal("want error for invalid format")
+	}
+}
+
+func TestConcurrentOptions(t *testing.T) {
+	src := []byte(`package foo
+
+import "github.com/hashicorp/consul/testutil"
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`)
+	a := DefaultOptions()
+	a.NilMessage = "not yet"
+
+	b := DefaultOptions()
+	b.RetryAlias, b.Timeout = "rt", 5*time.Second
+
+	tests := []struct {
+		opts Options
+		want []string
+	}{
+		{a, []string{"retry.OneSec()", `t.Log("not yet")`}},
+		{b, []string{`rt "github.com/hashicorp/consul/sdk/testutil/retry"`, "Timeout: 5 * time.Second"}},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		for _, tt := range tests {
+			wg.Add(1)
+			go func(opts Options, want []string) {
+				defer wg.Done()
+				out, err := Transform(src, opts)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, w := range want {
+					if !strings.Contains(string(out), w) {
+						errs <- fmt.Errorf("output does not contain %q:\n%s", w, out)
+						return
+					}
+				}
+			}(tt.opts, tt.want)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestPackages(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+	if err := cluster.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	opts := DefaultOptions()
+	opts.Packages = []string{"testutil"}
+	got, n, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d conversions want 1", n)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+
+	opts.Packages = []string{"other"}
+	got, n, err = TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || string(got) != in {
+		t.Fatalf("got %d conversions\n%s\nwant the file unchanged", n, got)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	want := 3
+	if err := testutil.WaitForResult(func() (bool, error) {
+		for _, s := range servers {
+			if !s.Ready() {
+				return false, fmt.Errorf("%s: not ready", s)
+			}
+		}
+		return len(servers) == want, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err := testutil.WaitForResultRetries(10, func() (bool, error) {
+		return ready(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh <- testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	})
+	go func() {
+		testutil.WaitForResult(func() (bool, error) {
+			return ready(), nil
+		})
+	}()
+}
+`
+	for _, format := range []string{"none", "gofmt"} {
+		t.Run(format, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = format
+			once, n, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Fatalf("got %d conversions want 2", n)
+			}
+			twice, n, err := TransformFile("foo_test.go", once, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 0 {
+				t.Fatalf("got %d conversions on the second pass want 0", n)
+			}
+			if !bytes.Equal(once, twice) {
+				t.Fatalf("second pass changed the file\n%s\nwant\n%s", twice, once)
+			}
+		})
+	}
+}
+
+func TestErrorfFuncs(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		if n := len(members()); n != 3 {
+			return false, errf("got %d members want 3", n)
+		}
+		if err := ping(); err != nil {
+			return false, newError("ping", err)
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if n := len(members()); n != 3 {
+			t.Logf("got %d members want 3", n)
+			continue
+		}
+		if err := ping(); err != nil {
+			t.Log(newError("ping", err))
+			continue
+		}
+		break
+	}
+}
+`
+	opts := DefaultOptions()
+	opts.ErrorfFuncs = []string{"errf"}
+	got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func TestRetryAPI(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); %s; {
+		if ready() {
+			break
+		}
+	}
+}
+`
+	tests := []struct {
+		api, cond string
+	}{
+		{"v1", "r.NextOr(t.FailNow)"},
+		{"v2", "r.NextOr(t, t.FailNow)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.api, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.RetryAPI = tt.api
+			got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf(out, tt.cond); string(got) != want {
+				t.Fatalf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+
+	opts := DefaultOptions()
+	opts.RetryAPI = "v3"
+	if _, _, err := TransformFile("foo_test.go", []byte(in), opts); err == nil {
+		t.Fatal("want error for retry api v3")
+	}
+}
+
+func TestComplexCondition(t *testing.T) {
+	in := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil && !errors.Is(err, errShutdown) {
+		t.Fatal(err)
+	}
+	err := testutil.WaitForResult(func() (bool, error) {
+		return leader() != "", nil
+	})
+	if err != nil && !errors.As(err, &timeout) {
+		t.Fatal(err)
+	}
+}
+`
+	var skipped []string
+	opts := DefaultOptions()
+	opts.Skipped = func(pos token.Position, reason string) {
+		skipped = append(skipped, fmt.Sprintf("%s: %s", pos, reason))
+	}
+	got, n, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != in || n != 0 {
+		t.Fatalf("got %d calls converted\n%s\nwant\n%s", n, got, in)
+	}
+	want := []string{
+		"foo_test.go:4:12: unsupported form",
+		"foo_test.go:9:9: unsupported form",
+	}
+	if !reflect.DeepEqual(skipped, want) {
+		t.Fatalf("got skipped %q want %q", skipped, want)
+	}
+}
+
+func TestSuccessWithError(t *testing.T) {
+	in := `package foo
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		if err := ping(); err != nil {
+			return true, err
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import "github.com/hashicorp/consul/sdk/testutil/retry"
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if err := ping(); err != nil {
+			break
+		}
+		break
+	}
+}
+`
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Warnings = &buf
+	got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+	want := "foo_test.go:6:4: warning: success returned with the error err which is dropped\n"
+	if buf.String() != want {
+		t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestTrailingSkipOrPanic(t *testing.T) {
+	tests := []struct {
+		desc, in, out, warnings string
+	}{
+		{
+			"t.Skip",
+			`
+		if err := ping(); err != nil {
+			return false, err
+		}
+		t.Skip("not supported")
+`,
+			`
+		if err := ping(); err != nil {
+			t.Log(err)
+			continue
+		}
+		t.Skip("not supported")
+`,
+			"foo_test.go:8:3: warning: t.Skip in a callback skips the test in the first attempt instead of retrying\n",
+		},
+		{
+			"panic",
+			`
+		if err := ping(); err != nil {
+			return false, err
+		}
+		panic("unreachable")
+`,
+			`
+		if err := ping(); err != nil {
+			t.Log(err)
+			continue
+		}
+		panic("unreachable")
+`,
+			"",
+		},
+		{
+			"no return",
+			`
+		require.NoError(t, ping())
+`,
+			`
+		if err := ping(); err != nil {
+			t.Log(err)
+			continue
+		}
+		break
+`,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			in := "package foo\n\nfunc TestFoo(t *testing.T) {\n\tif err := testutil.WaitForResult(func() (bool, error) {" + tt.in + "\t}); err != nil {\n\t\tt.Fatal(err)\n\t}\n}\n"
+			var buf bytes.Buffer
+			opts := DefaultOptions()
+			opts.Warnings = &buf
+			got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := "func TestFoo(t *testing.T) {\n\tfor r := retry.OneSec(); r.NextOr(t.FailNow); {" + tt.out + "\t}\n}\n"
+			if !strings.HasSuffix(string(got), out) {
+				t.Fatalf("got\n%s\nwant\n%s", got, out)
+			}
+			if buf.String() != tt.warnings {
+				t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), tt.warnings)
+			}
+		})
+	}
+}
+
+func TestReturnErr(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func waitForLeader(t *testing.T) error {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return leader() != "", nil
+	}); err != nil {
+		return err
+	}
+	err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	})
+	if err != nil {
+		return fmt.Errorf("not ready: %v", err)
+	}
+	return nil
+}
+`
+	convert := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func waitForLeader(t *testing.T) error {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if leader() != "" {
+			break
+		}
+	}
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+	return nil
+}
+`
+	tests := []struct {
+		mode, out, warn string
+		n               int
+	}{
+		{"warn", in, "foo_test.go:10:12: warning: WaitForResult call with an error check which returns the error not converted\n" +
+			"foo_test.go:15:9: warning: WaitForResult call with an error check which returns the error not converted\n", 0},
+		{"convert", convert, "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := DefaultOptions()
+			opts.ReturnErr = tt.mode
+			opts.Warnings = &buf
+			got, n, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.n {
+				t.Fatalf("got %d conversions want %d", n, tt.n)
+			}
+			if string(got) != tt.out {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.out)
+			}
+			if buf.String() != tt.warn {
+				t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), tt.warn)
+			}
+		})
+	}
+}
+
+func TestEnclosingLoop(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	// wait for the leader
+	for {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			return leader() != "", nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	for {
+		if err := testutil.WaitForResult(func() (bool, error) {
+			return ready(), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if done() {
+			break
+		}
+	}
+}
+`
+	out := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	// wait for the leader
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if leader() != "" {
+			break
+		}
+	}
+	for {
+		for r := retry.OneSec(); r.NextOr(t.FailNow); {
+			if ready() {
+				break
+			}
+		}
+		if done() {
+			break
+		}
+	}
+}
+`
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.Warnings = &buf
+	got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != out {
+		t.Fatalf("got\n%s\nwant\n%s", got, out)
+	}
+	want := "foo_test.go:20:3: warning: retry loop in a for loop without condition\n"
+	if buf.String() != want {
+		t.Fatalf("got warnings\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestUseSpaces(t *testing.T) {
+	in := `package foo
+
+import "github.com/hashicorp/consul/testutil"
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	out := `package foo
+
+import "github.com/hashicorp/consul/sdk/testutil/retry"
+
+func TestFoo(t *testing.T) {
+    for r := retry.OneSec(); r.NextOr(t.FailNow); {
+        if ready() {
+            break
+        }
+    }
+}
+`
+	for _, format := range []string{"none", "gofmt"} {
+		t.Run(format, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Format = format
+			opts.TabWidth = 4
+			opts.UseSpaces = true
+			got, _, err := TransformFile("foo_test.go", []byte(in), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != out {
+				t.Fatalf("got\n%s\nwant\n%s", got, out)
+			}
+		})
+	}
+}
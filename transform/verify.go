@@ -0,0 +1,87 @@
+package transform
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// verify type checks the source of the file before and after
+// the rewrite and returns the type errors which occur only
+// after it.
+//
+// The file is checked on its own without the other files of
+// the package. The errors for the declarations of the other
+// files are the same before and after the rewrite and are
+// ignored. The packages which cannot be imported are only
+// checked for whether the file still uses them since the
+// type checker does not report them as unused.
+func verify(fname string, in, out []byte) error {
+	before, _, err := typeErrors(fname, in)
+	if err != nil {
+		return err
+	}
+	after, fset, err := typeErrors(fname, out)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]int{}
+	for _, e := range before {
+		seen[e.Msg]++
+	}
+	var errs scanner.ErrorList
+	for _, e := range after {
+		if seen[e.Msg] > 0 {
+			seen[e.Msg]--
+			continue
+		}
+		errs.Add(fset.Position(e.Pos), "rewrite does not compile: "+e.Msg)
+	}
+	errs.Sort()
+	return errs.Err()
+}
+
+// typeErrors returns the errors of the type check of
+// the source of a single file.
+func typeErrors(fname string, src []byte) ([]types.Error, *token.FileSet, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, fname, src, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var errs []types.Error
+	conf := types.Config{
+		Importer: importer.Default(),
+		Error: func(err error) {
+			e, ok := err.(types.Error)
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(e.Msg, "could not import") {
+				imp := importAt(f, e.Pos)
+				if imp == nil || usesPkg(f, importName(imp)) {
+					return
+				}
+				e.Pos, e.Msg = imp.Pos(), imp.Path.Value+" imported and not used"
+			}
+			errs = append(errs, e)
+		},
+	}
+	conf.Check(f.Name.Name, fset, []*ast.File{f}, nil)
+	return errs, fset, nil
+}
+
+// importAt returns the import spec of the file at pos or nil.
+func importAt(f *ast.File, pos token.Pos) *ast.ImportSpec {
+	for _, imp := range f.Imports {
+		if imp.Pos() <= pos && pos < imp.End() {
+			return imp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	in := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	if err := testutil.WaitForResult(func() (bool, error) {
+		return ready(), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+`
+	ok := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+}
+`
+	broken := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r2.NextOr(t.FailNow); {
+		if ready() {
+			break retry
+		}
+	}
+}
+`
+	if err := verify("foo_test.go", []byte(in), []byte(ok)); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+
+	err := verify("foo_test.go", []byte(in), []byte(broken))
+	want := "foo_test.go:10:6: rewrite does not compile: declared and not used: r (and 2 more errors)"
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error %v want %s", err, want)
+	}
+
+	// the packages cannot be imported in the test
+	unused := `package foo
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil/retry"
+	tu "github.com/hashicorp/consul/testutil"
+)
+
+func TestFoo(t *testing.T) {
+	for r := retry.OneSec(); r.NextOr(t.FailNow); {
+		if ready() {
+			break
+		}
+	}
+}
+`
+	err = verify("foo_test.go", []byte(strings.NewReplacer(`"github.com`, `tu "github.com`, "testutil.", "tu.").Replace(in)), []byte(unused))
+	want = `foo_test.go:7:2: rewrite does not compile: "github.com/hashicorp/consul/testutil" imported and not used`
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error %v want %s", err, want)
+	}
+}